@@ -6,77 +6,41 @@ import (
 	"strings"
 
 	"github.com/linuxkit/virtsock/pkg/hvsock"
-	"github.com/linuxkit/virtsock/pkg/vsock"
 )
 
 var (
 	svcid, _ = hvsock.GUIDFromString("3049197C-FACB-11E6-BD58-64006A7986D3")
-	useHVSock = false
 )
 
 type hvsockAddr struct {
 	hvAddr hvsock.Addr
-	vAddr  vsock.Addr
-}
-
-func init() {
-	// Check which version (hvsock/vsock) we should use for Hyper-V sockets
-	useHVSock = hvsock.Supported()
 }
 
 // hvsockParseSockStr extracts the vmid and svcid from a string.
 // The format is "VMID:Service", "VMID", or ":Service" as well as an
-// empty string. For VMID we also support "parent" and assume
-// "loopback" if the string can't be parsed.
+// empty string. VMID and Service are parsed by hvsock.ParseAddr, so
+// for VMID we also support names such as "parent" and "loopback".
 func hvsockParseSockStr(sockStr string) hvsockAddr {
-	hvAddr := hvsock.Addr{hvsock.GUIDZero, svcid}
-	port, _ := svcid.Port() 
-	vAddr := vsock.Addr{vsock.CIDAny, port}
+	hvAddr := hvsock.Addr{VMID: hvsock.GUIDZero, ServiceID: svcid}
 	if sockStr == "" {
-		return hvsockAddr{hvAddr: hvAddr, vAddr: vAddr}
+		return hvsockAddr{hvAddr: hvAddr}
 	}
 
-	var err error
-	vmStr := ""
+	vmStr := sockStr
 	svcStr := ""
-	if strings.Contains(sockStr, ":") {
-		vmStr, svcStr, err = net.SplitHostPort(sockStr)
-		if err != nil {
-			log.Fatalf("Error parsing socket string '%s': %v", sockStr, err)
-		}
-	} else {
-		vmStr = sockStr
+	if i := strings.Index(sockStr, ":"); i >= 0 {
+		vmStr, svcStr = sockStr[:i], sockStr[i+1:]
 	}
-
-	if vmStr != "" {
-		if strings.Contains(vmStr, "-") {
-			if !useHVSock {
-				log.Fatalf("Can't use VM GUIDs in vsock mode")			
-			}
-			hvAddr.VMID, err = hvsock.GUIDFromString(vmStr)
-			if err != nil {
-				log.Fatalf("Error parsing VM '%s': %v", vmStr, err)
-			}
-		} else if vmStr == "parent" {
-			hvAddr.VMID = hvsock.GUIDParent
-			vAddr.CID = vsock.CIDHost
-		} else {
-			hvAddr.VMID = hvsock.GUIDLoopback
-			vAddr.CID = vsock.CIDHypervisor
-		}
+	if svcStr == "" {
+		svcStr = svcid.String()
 	}
 
-	if svcStr != "" {
-		if hvAddr.ServiceID, err = hvsock.GUIDFromString(svcStr); err != nil {
-			log.Fatalf("Error parsing SVC '%s': %v", svcStr, err)
-		}
-		if !useHVSock {
-			if vAddr.Port, err = hvAddr.ServiceID.Port(); err != nil {
-				log.Fatal("Error parsing SVC '%s': %v", svcStr, err)
-			}
-		}
+	var err error
+	hvAddr, err = hvsock.ParseAddr(vmStr + ":" + svcStr)
+	if err != nil {
+		log.Fatalf("Error parsing socket string '%s': %v", sockStr, err)
 	}
-	return hvsockAddr{hvAddr: hvAddr, vAddr: vAddr}
+	return hvsockAddr{hvAddr: hvAddr}
 }
 
 func (s hvsockAddr) String() string {
@@ -85,22 +49,12 @@ func (s hvsockAddr) String() string {
 
 // Dial connects on a Hyper-V socket
 func (s hvsockAddr) Dial(conid int) (Conn, error) {
-	if !useHVSock {
-		return vsock.Dial(s.vAddr.CID, s.vAddr.Port)
-	}
-	return hvsock.Dial(s.hvAddr)
+	return hvsock.DialAuto(s.hvAddr)
 }
 
 // Listen returns a net.Listener for a given Hyper-V socket
 func (s hvsockAddr) Listen() net.Listener {
-	if !useHVSock {
-		l, err := vsock.Listen(s.vAddr.CID, s.vAddr.Port)
-		if err != nil {
-			log.Fatalln("Listen():", err)
-		}
-		return l
-	}
-	l, err := hvsock.Listen(s.hvAddr)
+	l, err := hvsock.ListenAuto(s.hvAddr)
 	if err != nil {
 		log.Fatalln("Listen():", err)
 	}
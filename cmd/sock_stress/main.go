@@ -30,6 +30,7 @@ var (
 	verbose     int
 	exitOnError bool
 	parallel    int
+	zeroCopy    bool
 
 	connCounter int32
 )
@@ -68,6 +69,7 @@ func init() {
 	flag.IntVar(&parallel, "p", 1, "Run n connections in parallel")
 	flag.BoolVar(&exitOnError, "e", false, "Exit when an error occurs")
 	flag.IntVar(&verbose, "v", 0, "Set the verbosity level")
+	flag.BoolVar(&zeroCopy, "z", false, "Send with MSG_ZEROCOPY (vsock on Linux, only used for buffers of 64KiB or more)")
 
 	flag.Usage = func() {
 		prog := filepath.Base(os.Args[0])
@@ -84,6 +86,7 @@ func init() {
 		fmt.Printf("-c and -s take a URL as argument (or just the address scheme):\n")
 		fmt.Printf("Supported protocols are:\n")
 		fmt.Printf("  vsock     virtio sockets (Linux and HyperKit\n")
+		fmt.Printf("  vsockgram virtio datagram sockets (Linux)\n")
 		fmt.Printf("  hvsock    Hyper-V sockets (Linux and Windows)\n")
 		fmt.Printf("  tcp,tcp4  TCP/IPv4 socket\n")
 		fmt.Printf("  tcp6      TCP/IPv6 socket\n")
@@ -99,6 +102,8 @@ func init() {
 		fmt.Printf("  %s -s vsock            Start server in vsock mode on standard port\n", prog)
 		fmt.Printf("  %s -s vsock://:1235    Start server in vsock mode on a non-standard port\n", prog)
 		fmt.Printf("  %s -c hvsock://<vmid>  Start client in hvsock mode connecting to VM with <vmid>\n", prog)
+		fmt.Printf("  %s -c vsock://2 -z -B 1048576 -b 1048576\n", prog)
+		fmt.Printf("                         Start client in vsock mode sending 1MB buffers with MSG_ZEROCOPY\n")
 	}
 	rand.Seed(time.Now().UnixNano())
 }
@@ -118,7 +123,7 @@ func main() {
 
 	var t Test
 	switch n {
-	case "udp", "udp4", "udp6":
+	case "udp", "udp4", "udp6", "vsockgram":
 		t = newDgramEchoTest()
 	default:
 		t = newStreamEchoTest()
@@ -171,6 +176,10 @@ func parseSockStr(inStr string) (string, Sock) {
 	switch u.Scheme {
 	case "vsock":
 		return u.Scheme, vsockParseSockStr(u.Host)
+	case "vsockgram":
+		s := vsockParseSockStr(u.Host)
+		s.dgram = true
+		return u.Scheme, s
 	case "hvsock":
 		return u.Scheme, hvsockParseSockStr(u.Host)
 	case "tcp", "tcp4", "tcp6":
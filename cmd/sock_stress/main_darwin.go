@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"log"
 
 	"github.com/linuxkit/virtsock/pkg/vsock"
 )
@@ -15,5 +16,7 @@ func init() {
 }
 
 func hostInit() {
-	vsock.SocketMode(socketMode)
+	if err := vsock.SocketMode(socketMode); err != nil {
+		log.Fatalln(err)
+	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"runtime"
@@ -15,49 +16,57 @@ const (
 )
 
 type vsockAddr struct {
-	addr vsock.Addr
+	addr  vsock.Addr
+	dgram bool
+}
+
+// vsockPacketConn is a hacky way to get a vsock.PacketConn to implement the Conn interface
+type vsockPacketConn struct {
+	vsock.PacketConn
 }
 
 // vsockParseSockStr extracts the cid and port from a string.
 // The format is "CID:Port", "CID", or ":Port" as well as an empty string.
+// CID and Port are parsed by vsock.ParseAddr, so the CID may also be
+// a well-known name such as "host". An empty CID or Port is replaced by
+// the default for the platform.
 func vsockParseSockStr(sockStr string) vsockAddr {
-	a := vsock.Addr{vsock.CIDAny, vsockPort}
+	a := vsock.Addr{CID: vsock.CIDAny, Port: vsockPort}
 	// For listeners on the host the CID needs to be CIDHost
 	if runtime.GOOS == "darwin" {
 		a.CID = vsock.CIDHost
 	}
 
 	if sockStr == "" {
-		return vsockAddr{a}
+		return vsockAddr{addr: a}
 	}
-
-	var err error
-	cidStr := ""
-	portStr := ""
-	if strings.Contains(sockStr, ":") {
-		cidStr, portStr, err = net.SplitHostPort(sockStr)
-		if err != nil {
-			log.Fatalf("Error parsing socket string '%s': %v", sockStr, err)
+	// The hex form returned by vsock.Addr.String() specifies both
+	// the CID and the port. Any other form is parsed only after the
+	// defaults have been filled in, as vsock.ParseAddr treats an
+	// empty CID as CIDAny.
+	if !strings.Contains(sockStr, ":") {
+		if addr, err := vsock.ParseAddr(sockStr); err == nil {
+			return vsockAddr{addr: addr}
 		}
-	} else {
-		cidStr = sockStr
 	}
 
-	if cidStr != "" {
-		cid, err := strconv.ParseUint(cidStr, 10, 32)
-		if err != nil {
-			log.Fatalf("Error parsing '%s': %v", cidStr, err)
-		}
-		a.CID = uint32(cid)
+	cidStr := sockStr
+	portStr := ""
+	if i := strings.LastIndex(sockStr, ":"); i >= 0 {
+		cidStr, portStr = sockStr[:i], sockStr[i+1:]
 	}
-	if portStr != "" {
-		port, err := strconv.ParseUint(portStr, 10, 32)
-		if err != nil {
-			log.Fatalf("Error parsing '%s': %v", portStr, err)
-		}
-		a.Port = uint32(port)
+	if cidStr == "" {
+		cidStr = strconv.FormatUint(uint64(a.CID), 10)
+	}
+	if portStr == "" {
+		portStr = strconv.FormatUint(uint64(a.Port), 10)
+	}
+
+	addr, err := vsock.ParseAddr(cidStr + ":" + portStr)
+	if err != nil {
+		log.Fatalf("Error parsing socket string '%s': %v", sockStr, err)
 	}
-	return vsockAddr{a}
+	return vsockAddr{addr: addr}
 }
 
 func (s vsockAddr) String() string {
@@ -66,7 +75,26 @@ func (s vsockAddr) String() string {
 
 // Dial connects on a virtio socket
 func (s vsockAddr) Dial(conid int) (Conn, error) {
-	return vsock.Dial(s.addr.CID, s.addr.Port)
+	if s.dgram {
+		c, err := vsock.DialPacket(s.addr.CID, s.addr.Port)
+		if err != nil {
+			return nil, err
+		}
+		return vsockPacketConn{c}, nil
+	}
+	c, err := vsock.Dial(s.addr.CID, s.addr.Port)
+	if err != nil {
+		return nil, err
+	}
+	if zeroCopy {
+		zc, ok := c.(vsock.ZeroCopier)
+		if !ok {
+			prInfo("[%05d] Zero-copy not supported on this platform\n", conid)
+		} else if err := zc.SetZeroCopy(true); err != nil {
+			prInfo("[%05d] Zero-copy not supported, copying instead: %s\n", conid, err)
+		}
+	}
+	return c, nil
 }
 
 // Listen returns a net.Listener for a given virtio socket
@@ -78,8 +106,21 @@ func (s vsockAddr) Listen() net.Listener {
 	return l
 }
 
-// ListenPacket is not implemented for virtio sockets
+// ListenPacket returns a net.PacketConn for a given virtio datagram socket
 func (s vsockAddr) ListenPacket() net.PacketConn {
-	log.Fatalln("ListenPacket(): not implemented for virtio sockets")
-	return nil
+	pc, err := vsock.ListenPacket(s.addr.CID, s.addr.Port)
+	if err != nil {
+		log.Fatalln("ListenPacket():", err)
+	}
+	return pc
+}
+
+// CloseRead is dummy function to conform with the Conn interface
+func (c vsockPacketConn) CloseRead() error {
+	return fmt.Errorf("Unimplemented")
+}
+
+// CloseWrite is dummy function to conform with the Conn interface
+func (c vsockPacketConn) CloseWrite() error {
+	return fmt.Errorf("Unimplemented")
 }
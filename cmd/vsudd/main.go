@@ -8,6 +8,7 @@ import (
 	"log/syslog"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
@@ -59,8 +60,8 @@ func (f *forwards) Set(value string) error {
 func init() {
 	flag.Var(&inForwards, "inport", "incoming port to forward")
 	flag.StringVar(&syslogFwd, "syslog", "", "enable syslog forwarding")
-	flag.BoolVar(&detach, "detach", false, "detach from terminal")
-	flag.StringVar(&pidfile, "pidfile", "", "pid file")
+	flag.BoolVar(&detach, "detach", false, "detach from terminal (not needed when run by systemd)")
+	flag.StringVar(&pidfile, "pidfile", "", "pid file (not needed when run by systemd)")
 }
 
 func main() {
@@ -116,6 +117,11 @@ func main() {
 
 	connid := 0
 
+	// Sockets passed in by systemd socket activation, keyed by the
+	// vsock port or service GUID they are for.
+	activated := sdListenFds()
+	var listeners []net.Listener
+
 	for _, inF := range inForwards {
 		var portstr = inF.vsock
 		var network = inF.net
@@ -129,36 +135,31 @@ func main() {
 
 		log.Printf("incoming port forward from %s to %s", portstr, usock)
 
-		if strings.Contains(portstr, "-") {
+		if f, ok := activated[portstr]; ok {
+			var err error
+			l, err = vsock.FileListener(f)
+			if err != nil {
+				log.Fatalf("Failed to use socket activated listener for %s: %s", portstr, err)
+			}
+			f.Close()
+			delete(activated, portstr)
+			log.Printf("Listening on %s using socket activated listener", portstr)
+			useHVsock = strings.Contains(portstr, "-")
+		} else if strings.Contains(portstr, "-") {
 			svcid, err := hvsock.GUIDFromString(portstr)
 			if err != nil {
 				log.Fatalln("Failed to parse GUID", portstr, err)
 			}
-			// Check which version of Hyper-V socket bindings to use
-			if hvsock.Supported() {
-				// Use old interface
-				l, err = hvsock.Listen(hvsock.Addr{VMID: hvsock.GUIDWildcard, ServiceID: svcid})
-				if err != nil {
-					log.Fatalf("Failed to bind to hvsock port: %s", err)
-				}
-				log.Printf("Listening on ServiceId %s using hvsock", svcid)
-			} else {
-				// Use new interface
-				port, err := svcid.Port()
-				if err != nil {
-					log.Fatalf("Failed to convert hvsock port: %s", err)
-				}
-				l, err = vsock.Listen(vsock.CIDAny, port)
-				if err != nil {
-					log.Fatalf("Failed to bind to vsock port: %s", err)
-				}
-				log.Printf("Listening on ServiceId %s using vsock", svcid)
+			l, err = hvsock.ListenAll(hvsock.Addr{VMID: hvsock.GUIDWildcard, ServiceID: svcid})
+			if err != nil {
+				log.Fatalf("Failed to bind to hvsock port: %s", err)
 			}
+			log.Printf("Listening on ServiceId %s", svcid)
 			useHVsock = true
 		} else {
 			port, err := strconv.ParseUint(portstr, 10, 32)
 			if err != nil {
-				log.Fatalln("Can't convert %s to a uint.", portstr, err)
+				log.Fatalf("Can't convert %s to a uint: %s", portstr, err)
 			}
 			l, err = vsock.Listen(vsock.CIDAny, uint32(port))
 			if err != nil {
@@ -168,6 +169,7 @@ func main() {
 			useHVsock = false
 		}
 
+		listeners = append(listeners, l)
 		wg.Add(1)
 
 		go func() {
@@ -186,6 +188,29 @@ func main() {
 		}()
 	}
 
+	for name, f := range activated {
+		log.Printf("Ignoring socket activated fd %s which does not match any -inport", name)
+		f.Close()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %s, shutting down", sig)
+		if err := sdNotify("STOPPING=1"); err != nil {
+			log.Printf("Failed to notify systemd: %s", err)
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+		os.Exit(0)
+	}()
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Failed to notify systemd: %s", err)
+	}
+
 	wg.Wait()
 }
 
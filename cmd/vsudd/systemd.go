@@ -0,0 +1,81 @@
+package main
+
+// Minimal support for running vsudd as a systemd service: socket
+// activation (see sd_listen_fds(3)) and readiness notification (see
+// sd_notify(3)).
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// sdListenFdsStart is the first file descriptor passed by systemd
+	sdListenFdsStart = 3
+)
+
+// sdListenFds returns the sockets passed in by systemd socket
+// activation, keyed by their name in LISTEN_FDNAMES (as configured with
+// FileDescriptorName= in the socket unit). The environment variables
+// are unset so they are not passed on to child processes.
+func sdListenFds() map[string]*os.File {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil
+	}
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	files := make(map[string]*os.File)
+	for i := 0; i < nfds; i++ {
+		fd := sdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		if _, ok := files[name]; ok {
+			log.Printf("Ignoring duplicate socket activated fd %d with name %s", fd, name)
+			syscall.Close(fd)
+			continue
+		}
+		files[name] = os.NewFile(uintptr(fd), name)
+	}
+	return files
+}
+
+// sdNotify sends a state string, e.g. "READY=1", to the service
+// manager. It does nothing if NOTIFY_SOCKET is not set, i.e. if we
+// were not started by systemd as a Type=notify service.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// Abstract sockets start with '@', which is handled by the net package.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -42,6 +42,15 @@ var (
 /* rfc5425 like scheme, see section 4.3 */
 func rfc5425Write(conn vConn, buf []byte) error {
 
+	// Send the length and the message with one system call if possible
+	if wv, ok := conn.(vsock.VectorWriter); ok {
+		_, err := wv.Writev([][]byte{[]byte(fmt.Sprintf("%d ", len(buf))), buf})
+		if err != nil {
+			console.Printf("Error in writev: %s", err)
+		}
+		return err
+	}
+
 	msglen := strings.NewReader(fmt.Sprintf("%d ", len(buf)))
 
 	_, err := io.Copy(conn, msglen)
@@ -68,30 +77,15 @@ func forwardSyslogDatagram(buf []byte, portstr string) error {
 					console.Fatalln("Failed to parse GUID", portstr, err)
 				}
 
-				// Check which version of Hyper-V socket bindings to use
-				if hvsock.Supported() {
-
-					conn, err = hvsock.Dial(hvsock.Addr{VMID: hvsock.GUIDWildcard, ServiceID: svcid})
-					if err != nil {
-						console.Printf("Failed to dial hvsock port: %s", err)
-						continue
-					}
-				} else {
-					port, err := svcid.Port()
-					if err != nil {
-						log.Fatalf("Failed to convert hvsock port: %s", err)
-					}
-					conn, err = vsock.Dial(vsock.CIDHost, port)
-					if err != nil {
-						console.Printf("Failed to dial vsock port %d: %s", port, err)
-						continue
-					}
-
+				conn, err = hvsock.DialAuto(hvsock.Addr{VMID: hvsock.GUIDWildcard, ServiceID: svcid})
+				if err != nil {
+					console.Printf("Failed to dial hvsock port: %s", err)
+					continue
 				}
 			} else {
 				port, err := strconv.ParseUint(portstr, 10, 32)
 				if err != nil {
-					console.Fatalln("Can't convert %s to a uint.", portstr, err)
+					console.Fatalf("Can't convert %s to a uint: %s", portstr, err)
 				}
 
 				conn, err = vsock.Dial(vsock.CIDHost, uint32(port))
@@ -0,0 +1,80 @@
+// Package writev implements vectored writes on the sockets of the vsock
+// and hvsock packages.
+package writev
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// maxIovecs is the maximum number of buffers passed to one writev(2)
+// call (IOV_MAX on Linux)
+const maxIovecs = 1024
+
+// Write writes all of bufs to the socket of rc, calling writev(2) as
+// often as needed. If limit is positive, each call writes at most
+// limit bytes. bufs is not modified. Errors of rc are returned
+// unchanged, those of writev(2) as *os.SyscallError.
+func Write(rc syscall.RawConn, bufs [][]byte, limit int) (int64, error) {
+	bufs = append([][]byte(nil), bufs...)
+	iovecs := make([]syscall.Iovec, 0, maxIovecs)
+	var written int64
+	for {
+		// Gather up to limit bytes
+		iovecs = iovecs[:0]
+		batch := 0
+		for _, b := range bufs {
+			if len(b) == 0 {
+				continue
+			}
+			if limit > 0 && len(b) > limit-batch {
+				b = b[:limit-batch]
+			}
+			iov := syscall.Iovec{Base: &b[0]}
+			iov.SetLen(len(b))
+			iovecs = append(iovecs, iov)
+			batch += len(b)
+			if batch == limit || len(iovecs) == maxIovecs {
+				break
+			}
+		}
+		if len(iovecs) == 0 {
+			return written, nil
+		}
+
+		var n uintptr
+		var errno syscall.Errno
+		err := rc.Write(func(fd uintptr) bool {
+			for {
+				n, _, errno = syscall.Syscall(syscall.SYS_WRITEV, fd, uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+				if errno != syscall.EINTR {
+					return errno != syscall.EAGAIN
+				}
+			}
+		})
+		if err == nil && errno != 0 {
+			err = os.NewSyscallError("writev", errno)
+		}
+		if err != nil {
+			return written, err
+		}
+		written += int64(n)
+		bufs = Consume(bufs, int64(n))
+	}
+}
+
+// Consume removes the first n bytes from bufs, modifying the first
+// remaining buffer in place like net.Buffers does.
+func Consume(bufs [][]byte, n int64) [][]byte {
+	for len(bufs) > 0 {
+		l := int64(len(bufs[0]))
+		if l > n {
+			bufs[0] = bufs[0][n:]
+			return bufs
+		}
+		n -= l
+		bufs = bufs[1:]
+	}
+	return bufs
+}
@@ -0,0 +1,122 @@
+package writev
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// seqpacketPair returns a raw connection to one end of a
+// SOCK_SEQPACKET socket pair, which preserves the size of each
+// writev(2), and the fd of the other end.
+func seqpacketPair(t *testing.T) (*os.File, int) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+	if err := syscall.SetNonblock(fds[0], true); err != nil {
+		t.Fatalf("SetNonblock: %v", err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "writev")
+	t.Cleanup(func() {
+		f.Close()
+		syscall.Close(fds[1])
+	})
+	return f, fds[1]
+}
+
+// readPackets reads packets from fd until n bytes have been read
+func readPackets(t *testing.T, fd, n int) [][]byte {
+	t.Helper()
+	var packets [][]byte
+	for n > 0 {
+		buf := make([]byte, 4096)
+		m, err := syscall.Read(fd, buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		packets = append(packets, buf[:m])
+		n -= m
+	}
+	return packets
+}
+
+func TestWrite(t *testing.T) {
+	for _, tc := range []struct {
+		limit   int
+		packets []string
+	}{
+		{0, []string{"hello world, this is a test"}},
+		{7, []string{"hello w", "orld, t", "his is ", "a test"}},
+		{6, []string{"hello ", "world,", " this ", "is a t", "est"}},
+	} {
+		f, peer := seqpacketPair(t)
+		rc, err := f.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bufs := [][]byte{[]byte("hello "), []byte("world, "), {}, []byte("this is a test")}
+		orig := append([][]byte(nil), bufs...)
+
+		n, err := Write(rc, bufs, tc.limit)
+		if err != nil || n != 27 {
+			t.Fatalf("limit %d: Write = %d, %v", tc.limit, n, err)
+		}
+		for i := range bufs {
+			if !bytes.Equal(bufs[i], orig[i]) {
+				t.Errorf("limit %d: bufs[%d] modified to %q", tc.limit, i, bufs[i])
+			}
+		}
+		packets := readPackets(t, peer, int(n))
+		if len(packets) != len(tc.packets) {
+			t.Fatalf("limit %d: got %q, want %q", tc.limit, packets, tc.packets)
+		}
+		for i := range packets {
+			if string(packets[i]) != tc.packets[i] {
+				t.Errorf("limit %d: packet %d is %q, want %q", tc.limit, i, packets[i], tc.packets[i])
+			}
+		}
+	}
+}
+
+func TestWriteClosed(t *testing.T) {
+	f, _ := seqpacketPair(t)
+	rc, err := f.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := Write(rc, [][]byte{[]byte("x")}, 0); err == nil {
+		t.Error("Write to closed file succeeded")
+	}
+
+	f, peer := seqpacketPair(t)
+	rc, err = f.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Shutdown(peer, syscall.SHUT_RD); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Write(rc, [][]byte{[]byte("x")}, 0)
+	var serr *os.SyscallError
+	if !errors.As(err, &serr) || !errors.Is(err, syscall.EPIPE) {
+		t.Errorf("Write to closed peer: got %v, want EPIPE", err)
+	}
+}
+
+func TestConsume(t *testing.T) {
+	b := net.Buffers{[]byte("abc"), []byte("def"), []byte("gh")}
+	b = Consume(b, 4)
+	if len(b) != 2 || string(b[0]) != "ef" || string(b[1]) != "gh" {
+		t.Errorf("Consume(4) = %q", b)
+	}
+	b = Consume(b, 4)
+	if len(b) != 0 {
+		t.Errorf("Consume of everything left %q", b)
+	}
+}
@@ -0,0 +1,78 @@
+package hvsock
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// vmidNames maps the well-known names accepted by ParseAddr to VM IDs.
+var vmidNames = map[string]GUID{
+	"any":       GUIDWildcard,
+	"wildcard":  GUIDWildcard,
+	"broadcast": GUIDBroadcast,
+	"children":  GUIDChildren,
+	"loopback":  GUIDLoopback,
+	"local":     GUIDLoopback,
+	"parent":    GUIDParent,
+	"host":      GUIDParent,
+}
+
+// ParseAddr parses a Hyper-V socket address of the form
+// "VMID:ServiceID" as returned by Addr.String(), optionally written as
+// a URL "hvsock://VMID:ServiceID/" (the scheme is case insensitive and
+// the trailing slash optional). Instead of a GUID the VMID may be one of the names
+// "any", "wildcard", "broadcast", "children", "loopback", "local",
+// "parent" or "host". An empty VMID is equivalent to "any". The
+// ServiceID may also be given as a decimal vsock port, which is
+// converted using the xxxxxxxx-facb-11e6-bd58-64006a7986d3 template.
+func ParseAddr(s string) (Addr, error) {
+	str := s
+	if i := strings.Index(s, "://"); i >= 0 {
+		// net/url can not be used, as a ServiceID is not a port
+		if !strings.EqualFold(s[:i], "hvsock") {
+			return Addr{}, fmt.Errorf("invalid hvsock address %q: unsupported scheme %q", s, s[:i])
+		}
+		str = strings.TrimSuffix(s[i+len("://"):], "/")
+	}
+
+	i := strings.LastIndex(str, ":")
+	if i < 0 {
+		return Addr{}, fmt.Errorf("invalid hvsock address %q: missing service ID", s)
+	}
+
+	var a Addr
+	var err error
+	vmStr, svcStr := str[:i], str[i+1:]
+	if vmStr == "" {
+		a.VMID = GUIDWildcard
+	} else if vmid, ok := vmidNames[strings.ToLower(vmStr)]; ok {
+		a.VMID = vmid
+	} else if a.VMID, err = GUIDFromString(vmStr); err != nil {
+		return Addr{}, fmt.Errorf("invalid hvsock address %q: bad VM ID: %w", s, err)
+	}
+
+	if port, err := strconv.ParseUint(svcStr, 10, 32); err == nil {
+		a.ServiceID = GUIDFromPort(uint32(port))
+	} else if a.ServiceID, err = GUIDFromString(svcStr); err != nil {
+		return Addr{}, fmt.Errorf("invalid hvsock address %q: bad service ID: %w", s, err)
+	}
+	return a, nil
+}
+
+// MarshalText implements encoding.TextMarshaler. The address is
+// formatted as by String().
+func (a Addr) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts all
+// the forms supported by ParseAddr.
+func (a *Addr) UnmarshalText(text []byte) error {
+	addr, err := ParseAddr(string(text))
+	if err != nil {
+		return err
+	}
+	*a = addr
+	return nil
+}
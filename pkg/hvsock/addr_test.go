@@ -0,0 +1,89 @@
+package hvsock
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	const (
+		vmid    = "3d2a0f8c-3b49-4a3b-9d26-2c3a1c7f0a11"
+		service = "00000400-facb-11e6-bd58-64006a7986d3"
+	)
+	vm, err := GUIDFromString(vmid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := GUIDFromPort(1024)
+
+	for _, tc := range []struct {
+		in   string
+		want Addr
+		ok   bool
+	}{
+		{vmid + ":" + service, Addr{vm, port}, true},
+		{"{" + vmid + "}:{" + service + "}", Addr{vm, port}, true},
+		{vmid + ":1024", Addr{vm, port}, true},
+		{"hvsock://" + vmid + ":" + service, Addr{vm, port}, true},
+		{"hvsock://" + vmid + ":" + service + "/", Addr{vm, port}, true},
+		{"HVSOCK://" + vmid + ":1024", Addr{vm, port}, true},
+		{":1024", Addr{GUIDWildcard, port}, true},
+		{"any:1024", Addr{GUIDWildcard, port}, true},
+		{"wildcard:1024", Addr{GUIDWildcard, port}, true},
+		{"broadcast:1024", Addr{GUIDBroadcast, port}, true},
+		{"children:1024", Addr{GUIDChildren, port}, true},
+		{"loopback:1024", Addr{GUIDLoopback, port}, true},
+		{"local:1024", Addr{GUIDLoopback, port}, true},
+		{"parent:1024", Addr{GUIDParent, port}, true},
+		{"HOST:1024", Addr{GUIDParent, port}, true},
+
+		{"", Addr{}, false},
+		{vmid, Addr{}, false},
+		{vmid + ":", Addr{}, false},
+		{vmid + ":junk", Addr{}, false},
+		{vmid + ":" + service + "x", Addr{}, false},
+		{vmid[:35] + ":1024", Addr{}, false},
+		{"guest:1024", Addr{}, false},
+		{vmid + ":4294967296", Addr{}, false},
+		{"vsock://" + vmid + ":1024", Addr{}, false},
+		{"hvsock://" + vmid + ":1024/path", Addr{}, false},
+	} {
+		got, err := ParseAddr(tc.in)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("ParseAddr(%q) = %s, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAddr(%q): %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseAddr(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAddrText(t *testing.T) {
+	type config struct {
+		Addr Addr
+	}
+	in := config{Addr{GUIDParent, GUIDFromPort(1024)}}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	want := `{"Addr":"a42e7cda-d03f-480c-9cc2-a4de20abb878:00000400-facb-11e6-bd58-64006a7986d3"}`
+	if string(b) != want {
+		t.Errorf("Marshal: got %s, want %s", b, want)
+	}
+
+	var out config
+	if err := json.Unmarshal([]byte(`{"Addr":"parent:1024"}`), &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if out != in {
+		t.Errorf("Unmarshal: got %s, want %s", out.Addr, in.Addr)
+	}
+}
@@ -0,0 +1,96 @@
+package hvsock
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// On Linux, Hyper-V sockets are either provided by the legacy
+// implementation (see Supported()) or, on 4.14.x and newer kernels, by
+// the vsock package. DialAuto and ListenAuto pick whichever is
+// available so that programs do not have to.
+
+var (
+	legacyOnce sync.Once
+	legacy     bool
+)
+
+// useLegacy returns true if the legacy implementation should be used.
+// This is decided once, on first use.
+func useLegacy() bool {
+	legacyOnce.Do(func() {
+		legacy = Supported()
+	})
+	return legacy
+}
+
+// DialAuto connects to raddr. If Hyper-V sockets are supported
+// natively (see Supported()) it is equivalent to Dial. Otherwise the
+// connection is made with the vsock package, which requires raddr to
+// be expressible as a vsock address:
+//   - the VM ID must be GUIDParent or GUIDWildcard, which connect to
+//     the host (vsock.CIDHost), or GUIDLoopback (vsock.CIDLocal).
+//   - the service ID must follow the template described in
+//     GUID.Port().
+func DialAuto(raddr Addr) (Conn, error) {
+	if useLegacy() {
+		return Dial(raddr)
+	}
+	cid, port, err := raddr.vsockAddr(false)
+	if err != nil {
+		return nil, err
+	}
+	return vsock.Dial(cid, port)
+}
+
+// ListenAuto listens on addr. If Hyper-V sockets are supported
+// natively (see Supported()) it is equivalent to Listen. Otherwise the
+// listener is created with the vsock package, which requires addr to
+// be expressible as a vsock address:
+//   - the VM ID must be GUIDWildcard, GUIDChildren or GUIDParent, which
+//     all listen on vsock.CIDAny, or GUIDLoopback (vsock.CIDLocal).
+//     vsock can not restrict which VMs may connect, so with
+//     GUIDChildren and GUIDParent connections from any VM or the host
+//     are accepted.
+//   - the service ID must follow the template described in
+//     GUID.Port().
+//
+// Listeners and connections created with the vsock package report
+// vsock addresses.
+func ListenAuto(addr Addr) (net.Listener, error) {
+	if useLegacy() {
+		return Listen(addr)
+	}
+	cid, port, err := addr.vsockAddr(true)
+	if err != nil {
+		return nil, err
+	}
+	return vsock.Listen(cid, port)
+}
+
+// vsockAddr converts a to a vsock CID and port for dialling or, if
+// listen is true, for listening.
+func (a Addr) vsockAddr(listen bool) (cid, port uint32, err error) {
+	switch {
+	case a.VMID == GUIDLoopback:
+		cid = vsock.CIDLocal
+	case a.VMID == GUIDWildcard || a.VMID == GUIDParent:
+		cid = vsock.CIDHost
+		if listen {
+			cid = vsock.CIDAny
+		}
+	case a.VMID == GUIDChildren && listen:
+		cid = vsock.CIDAny
+	default:
+		return 0, 0, fmt.Errorf("%s: VM ID %s can not be used with vsock", a, a.VMID.String())
+	}
+
+	port, err = a.ServiceID.Port()
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: service ID can not be used with vsock: %w", a, err)
+	}
+	return cid, port, nil
+}
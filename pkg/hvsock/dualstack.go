@@ -0,0 +1,334 @@
+package hvsock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// ListenAll listens on addr with every available Hyper-V socket
+// implementation, i.e. with the legacy implementation if Supported()
+// and with the vsock package if addr can be expressed as a vsock
+// address (see ListenAuto), and merges the accepted connections into
+// one listener. This allows a single program to serve both guests
+// with the legacy implementation and guests using vsock. It fails only
+// if none of the implementations can listen on addr. Likewise, if one
+// of the underlying listeners fails, the others continue to accept
+// connections, and Accept only returns an error once all of them have
+// failed or the listener has been closed.
+//
+// The addresses of all connections are reported as Addr. For vsock
+// connections the service ID is derived from the port with
+// GUIDFromPort() and the VM ID is GUIDParent for the host, GUIDLoopback
+// for local connections and GUIDWildcard otherwise, as a CID has no
+// corresponding VM ID.
+func ListenAll(addr Addr) (net.Listener, error) {
+	var ls []net.Listener
+	var errs []string
+
+	if Supported() {
+		l, err := Listen(addr)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			ls = append(ls, l)
+		}
+	}
+
+	if cid, port, err := addr.vsockAddr(true); err != nil {
+		errs = append(errs, err.Error())
+	} else if l, err := vsock.Listen(cid, port); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		ls = append(ls, &vsockListener{Listener: l, local: addr})
+	}
+
+	if len(ls) == 0 {
+		return nil, fmt.Errorf("listen(%s) failed: %s", addr, strings.Join(errs, "; "))
+	}
+	return newMultiListener(addr, ls), nil
+}
+
+// multiListener merges the connections accepted by several listeners.
+// The failure of one listener is not reported while others still
+// accept connections.
+type multiListener struct {
+	local     Addr
+	listeners []net.Listener
+	accepted  chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	errs []string // errors of the listeners which failed
+}
+
+const (
+	// minAcceptDelay and maxAcceptDelay bound the back-off after a
+	// temporary error from Accept, e.g. when running out of fds.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+func newMultiListener(local Addr, ls []net.Listener) *multiListener {
+	m := &multiListener{
+		local:     local,
+		listeners: ls,
+		accepted:  make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	for _, l := range ls {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			m.acceptLoop(l)
+		}(l)
+	}
+	go func() {
+		// Once all listeners have failed Accept returns an error
+		wg.Wait()
+		close(m.accepted)
+	}()
+	return m
+}
+
+// acceptLoop passes connections accepted by l on to Accept until l
+// fails or the multiListener is closed. Temporary errors are retried
+// after a delay.
+func (m *multiListener) acceptLoop(l net.Listener) {
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if !isTemporary(err) {
+				m.mu.Lock()
+				m.errs = append(m.errs, err.Error())
+				m.mu.Unlock()
+				return
+			}
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			select {
+			case <-time.After(delay):
+				continue
+			case <-m.done:
+				return
+			}
+		}
+		delay = 0
+
+		select {
+		case m.accepted <- c:
+		case <-m.done:
+			c.Close()
+			return
+		}
+	}
+}
+
+// isTemporary returns true if err, or an error it wraps, reports
+// itself as temporary, like syscall.EMFILE.
+func isTemporary(err error) bool {
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// Accept returns the next connection accepted by any of the
+// listeners. It only fails once the listener is closed or all the
+// underlying listeners have failed.
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c, ok := <-m.accepted:
+		if ok {
+			return c, nil
+		}
+	case <-m.done:
+	}
+
+	select {
+	case <-m.done:
+		return nil, fmt.Errorf("accept(%s) failed: %w", m.local, net.ErrClosed)
+	default:
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return nil, fmt.Errorf("accept(%s) failed: %s", m.local, strings.Join(m.errs, "; "))
+}
+
+// Close closes all the listeners. A pending Accept returns
+// net.ErrClosed.
+func (m *multiListener) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, l := range m.listeners {
+			if lerr := l.Close(); lerr != nil && err == nil {
+				err = lerr
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address the listener is listening on
+func (m *multiListener) Addr() net.Addr {
+	return m.local
+}
+
+// vsockListener is a vsock listener whose connections report Addr
+// addresses
+type vsockListener struct {
+	net.Listener
+	local Addr
+}
+
+// Accept accepts a connection and converts its addresses
+func (l *vsockListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	vc, ok := c.(vsock.Conn)
+	if !ok {
+		return c, nil
+	}
+	remote := &Addr{VMID: GUIDWildcard}
+	if ra, ok := c.RemoteAddr().(*vsock.Addr); ok {
+		remote = addrFromVsock(ra)
+	}
+	return &vsockConn{Conn: vc, local: &l.local, remote: remote}, nil
+}
+
+// addrFromVsock converts the vsock address of a peer to an Addr
+func addrFromVsock(a *vsock.Addr) *Addr {
+	vmid := GUIDWildcard
+	switch a.CID {
+	case vsock.CIDHost:
+		vmid = GUIDParent
+	case vsock.CIDLocal:
+		vmid = GUIDLoopback
+	}
+	return &Addr{VMID: vmid, ServiceID: GUIDFromPort(a.Port)}
+}
+
+// vsockConn is a vsock connection which reports Addr addresses. It
+// forwards the optional methods of the vsock package's connections, so
+// that, e.g., io.Copy still uses splice(2) and writev(2).
+type vsockConn struct {
+	vsock.Conn
+	local, remote *Addr
+}
+
+// errNotSupported is returned by the methods of vsockConn which the
+// underlying connection does not implement
+var errNotSupported = errors.New("operation not supported by the vsock connection")
+
+// LocalAddr returns the local address of the connection
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the remote address of the connection
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ReadFrom implements io.ReaderFrom using the underlying connection
+func (c *vsockConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
+
+// WriteTo implements io.WriterTo using the underlying connection
+func (c *vsockConn) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := c.Conn.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	return io.Copy(w, struct{ io.Reader }{c.Conn})
+}
+
+// Writev implements vsock.VectorWriter
+func (c *vsockConn) Writev(bufs [][]byte) (int64, error) {
+	if vw, ok := c.Conn.(vsock.VectorWriter); ok {
+		return vw.Writev(bufs)
+	}
+	b := net.Buffers(bufs)
+	return b.WriteTo(struct{ io.Writer }{c.Conn})
+}
+
+// SyscallConn returns a raw network connection, see syscall.Conn
+func (c *vsockConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errNotSupported
+}
+
+// SetZeroCopy implements vsock.ZeroCopier
+func (c *vsockConn) SetZeroCopy(enable bool) error {
+	if zc, ok := c.Conn.(vsock.ZeroCopier); ok {
+		return zc.SetZeroCopy(enable)
+	}
+	return errNotSupported
+}
+
+// BufferSize implements vsock.BufferSizer
+func (c *vsockConn) BufferSize() (uint64, error) {
+	if bs, ok := c.Conn.(vsock.BufferSizer); ok {
+		return bs.BufferSize()
+	}
+	return 0, errNotSupported
+}
+
+// SetBufferSize implements vsock.BufferSizer
+func (c *vsockConn) SetBufferSize(size uint64) error {
+	if bs, ok := c.Conn.(vsock.BufferSizer); ok {
+		return bs.SetBufferSize(size)
+	}
+	return errNotSupported
+}
+
+// BufferMinSize implements vsock.BufferSizer
+func (c *vsockConn) BufferMinSize() (uint64, error) {
+	if bs, ok := c.Conn.(vsock.BufferSizer); ok {
+		return bs.BufferMinSize()
+	}
+	return 0, errNotSupported
+}
+
+// SetBufferMinSize implements vsock.BufferSizer
+func (c *vsockConn) SetBufferMinSize(size uint64) error {
+	if bs, ok := c.Conn.(vsock.BufferSizer); ok {
+		return bs.SetBufferMinSize(size)
+	}
+	return errNotSupported
+}
+
+// BufferMaxSize implements vsock.BufferSizer
+func (c *vsockConn) BufferMaxSize() (uint64, error) {
+	if bs, ok := c.Conn.(vsock.BufferSizer); ok {
+		return bs.BufferMaxSize()
+	}
+	return 0, errNotSupported
+}
+
+// SetBufferMaxSize implements vsock.BufferSizer
+func (c *vsockConn) SetBufferMaxSize(size uint64) error {
+	if bs, ok := c.Conn.(vsock.BufferSizer); ok {
+		return bs.SetBufferMaxSize(size)
+	}
+	return errNotSupported
+}
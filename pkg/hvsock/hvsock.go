@@ -3,14 +3,17 @@
 // 4.9.x kernel. If you are using a Linux kernel 4.14.x or newer you
 // should use the vsock package instead as the Hyper-V socket support
 // in these kernels have been merged with the virtio sockets
-// implementation.
+// implementation, or DialAuto and ListenAuto, which use whichever of
+// the two is available.
 package hvsock
 
 import (
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
-	"reflect"
 )
 
 var (
@@ -29,16 +32,19 @@ var (
 
 	// GUIDs for LinuxVMs with the new Hyper-V socket implementation need to match this template
 	guidTemplate, _ = GUIDFromString("00000000-facb-11e6-bd58-64006a7986d3")
+
+	// ErrTimeout is an error returned on timeout. It implements
+	// net.Error with Timeout() returning true.
+	ErrTimeout = &timeoutError{}
 )
 
 const (
 	// The Hyper-V socket implementation used in the 4.9.x kernels
 	// seems to fail silently if messages are above 8k. The newer
 	// implementation in the 4.14.x (and newer) kernels seems to
-	// work fine with larger messages. This is constant is used as
-	// a temporary workaround to limit the amount of data sent and
-	// should be removed once support for 4.9.x kernels is
-	// deprecated.
+	// work fine with larger messages. This constant is the default
+	// limit on the amount of data sent at once where the legacy
+	// implementation may be involved, see DialOptions.MaxMsgSize.
 	maxMsgSize = 8 * 1024
 )
 
@@ -46,7 +52,7 @@ const (
 type GUID [16]byte
 
 // Convert a GUID into a string
-func (g *GUID) String() string {
+func (g GUID) String() string {
 	/* XXX This assume little endian */
 	return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%02x%02x-%02x%02x%02x%02x%02x%02x",
 		g[3], g[2], g[1], g[0],
@@ -62,23 +68,89 @@ func (g *GUID) String() string {
 // xxxxxxxx-facb-11e6-bd58-64006a7986d3, where xxxxxxxx is the vsock port.
 func (g *GUID) Port() (uint32, error) {
 	// Check that the GUID is as expected
-	if !reflect.DeepEqual(g[4:], guidTemplate[4:]) {
+	t := *g
+	copy(t[0:4], guidTemplate[0:4])
+	if t != guidTemplate {
 		return 0, fmt.Errorf("%s does not conform with the template", g)
 	}
 	return binary.LittleEndian.Uint32(g[0:4]), nil
 }
 
-// GUIDFromString parses a string and returns a GUID
+// GUIDFromPort returns the Service GUID for a vsock port. It is the
+// inverse of Port().
+func GUIDFromPort(port uint32) GUID {
+	g := guidTemplate
+	binary.LittleEndian.PutUint32(g[0:4], port)
+	return g
+}
+
+// GUIDFromString parses a string of the form
+// xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx, optionally enclosed in braces,
+// and returns a GUID. Hex digits may be upper or lower case.
 func GUIDFromString(s string) (GUID, error) {
 	var g GUID
-	var err error
-	_, err = fmt.Sscanf(s, "%02x%02x%02x%02x-%02x%02x-%02x%02x-%02x%02x-%02x%02x%02x%02x%02x%02x",
-		&g[3], &g[2], &g[1], &g[0],
-		&g[5], &g[4],
-		&g[7], &g[6],
-		&g[8], &g[9],
-		&g[10], &g[11], &g[12], &g[13], &g[14], &g[15])
-	return g, err
+	str := s
+	if len(str) == 38 && str[0] == '{' && str[37] == '}' {
+		str = str[1:37]
+	}
+	if len(str) != 36 || str[8] != '-' || str[13] != '-' || str[18] != '-' || str[23] != '-' {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	b, err := hex.DecodeString(str[0:8] + str[9:13] + str[14:18] + str[19:23] + str[24:36])
+	if err != nil {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	// The first three fields are stored little endian
+	g[0], g[1], g[2], g[3] = b[3], b[2], b[1], b[0]
+	g[4], g[5] = b[5], b[4]
+	g[6], g[7] = b[7], b[6]
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+// NewGUID returns a random (version 4) GUID, for example to use as a
+// Service ID.
+func NewGUID() (GUID, error) {
+	var g GUID
+	if _, err := io.ReadFull(rand.Reader, g[:]); err != nil {
+		return g, err
+	}
+	g[7] = g[7]&0x0f | 0x40 // version 4
+	g[8] = g[8]&0x3f | 0x80 // RFC 4122 variant
+	return g, nil
+}
+
+// Equal returns true if g and h are the same GUID
+func (g GUID) Equal(h GUID) bool {
+	return g == h
+}
+
+// IsZero returns true if g is GUIDZero
+func (g GUID) IsZero() bool {
+	return g == GUIDZero
+}
+
+// MarshalText implements encoding.TextMarshaler. The GUID is
+// formatted as by String().
+func (g GUID) MarshalText() ([]byte, error) {
+	return []byte(g.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts the
+// forms supported by GUIDFromString.
+func (g *GUID) UnmarshalText(text []byte) error {
+	guid, err := GUIDFromString(string(text))
+	if err != nil {
+		return err
+	}
+	*g = guid
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler. The GUID is encoded as a
+// string formatted as by String(). UnmarshalText is used to decode it.
+func (g GUID) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + g.String() + `"`), nil
 }
 
 // Addr represents a Hyper-V socket address
@@ -106,6 +178,12 @@ type Conn interface {
 	CloseWrite() error
 }
 
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
 // Since there doesn't seem to be a standard min function
 func min(x, y int) int {
 	if x < y {
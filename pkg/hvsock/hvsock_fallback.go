@@ -13,10 +13,14 @@ func Supported() bool {
 	return false
 }
 
-func Dial(raddr Addr) (Conn, error) {
+func defaultMsgSize() int {
+	return 0
+}
+
+func dial(raddr Addr, msgSize int) (Conn, error) {
 	return nil, fmt.Errorf("Dial() not implemented on %s", runtime.GOOS)
 }
 
-func Listen(addr Addr) (net.Listener, error) {
+func listen(addr Addr, msgSize int) (net.Listener, error) {
 	return nil, fmt.Errorf("Listen() not implemented on %s", runtime.GOOS)
 }
@@ -14,36 +14,14 @@ package hvsock
 // emulated CloseRead()/CloseWrite() as not all Windows builds support
 // it.
 
-/*
-#include <sys/socket.h>
-
-struct sockaddr_hv {
-	unsigned short shv_family;
-	unsigned short reserved;
-	unsigned char  shv_vm_id[16];
-	unsigned char  shv_service_id[16];
-};
-int bind_sockaddr_hv(int fd, const struct sockaddr_hv *sa_hv) {
-    return bind(fd, (const struct sockaddr*)sa_hv, sizeof(*sa_hv));
-}
-int connect_sockaddr_hv(int fd, const struct sockaddr_hv *sa_hv) {
-    return connect(fd, (const struct sockaddr*)sa_hv, sizeof(*sa_hv));
-}
-int accept_hv(int fd, struct sockaddr_hv *sa_hv, socklen_t *sa_hv_len) {
-    return accept(fd, (struct sockaddr *)sa_hv, sa_hv_len);
-}
-int getsockname_hv(int fd, struct sockaddr_hv *sa_hv, socklen_t *sa_hv_len) {
-    return getsockname(fd, (struct sockaddr *)sa_hv, sa_hv_len);
-}
-*/
-import "C"
-
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -53,11 +31,28 @@ const (
 	hvsockRaw = 1  // SHV_PROTO_RAW
 )
 
+// rawSockaddrHyperv is struct sockaddr_hv of the legacy implementation
+type rawSockaddrHyperv struct {
+	Family    uint16
+	Reserved  uint16
+	VMID      GUID
+	ServiceID GUID
+}
+
+// sizeofSockaddrHyperv is the size of struct sockaddr_hv
+const sizeofSockaddrHyperv = int(unsafe.Sizeof(rawSockaddrHyperv{}))
+
+// sockaddr returns the sockaddr_hv for a
+func (a Addr) sockaddr() *rawSockaddrHyperv {
+	return &rawSockaddrHyperv{
+		Family:    hvsockAF,
+		VMID:      a.VMID,
+		ServiceID: a.ServiceID,
+	}
+}
+
 // Supported returns if hvsocks are supported on your platform
 func Supported() bool {
-	var sa C.struct_sockaddr_hv
-	var sa_len C.socklen_t
-
 	// Try opening  a hvsockAF socket. If it works we are on older, i.e. 4.9.x kernels.
 	// 4.11 defines AF_SMC as 43 but it doesn't support protocol 1 so the
 	// socket() call should fail.
@@ -65,78 +60,81 @@ func Supported() bool {
 	if err != nil {
 		return false
 	}
+	defer syscall.Close(fd)
 
 	// 4.16 defines SMCPROTO_SMC6 as 1 but its socket name size doesn't match
 	// size of sockaddr_hv so corresponding check should fail.
-	sa_len = C.sizeof_struct_sockaddr_hv
-	ret, _ := C.getsockname_hv(C.int(fd), &sa, &sa_len)
-	syscall.Close(fd)
-	if ret < 0 || sa_len != C.sizeof_struct_sockaddr_hv {
+	var sa rawSockaddrHyperv
+	saLen := uint32(sizeofSockaddrHyperv)
+	_, _, e1 := unix.RawSyscall(unix.SYS_GETSOCKNAME, uintptr(fd), uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&saLen)))
+	if e1 != 0 || saLen != uint32(sizeofSockaddrHyperv) {
 		return false
 	}
 
 	return true
 }
 
-// Dial a Hyper-V socket address
-func Dial(raddr Addr) (Conn, error) {
-	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM, hvsockRaw)
+// defaultMsgSize returns the default limit on the size of send calls.
+// Connections of the legacy implementation are limited to maxMsgSize.
+func defaultMsgSize() int {
+	return maxMsgSize
+}
+
+func dial(raddr Addr, msgSize int) (Conn, error) {
+	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, hvsockRaw)
 	if err != nil {
 		return nil, err
 	}
 
-	sa := C.struct_sockaddr_hv{}
-	sa.shv_family = hvsockAF
-	sa.reserved = 0
-
-	for i := 0; i < 16; i++ {
-		sa.shv_vm_id[i] = C.uchar(raddr.VMID[i])
-	}
-	for i := 0; i < 16; i++ {
-		sa.shv_service_id[i] = C.uchar(raddr.ServiceID[i])
-	}
-
+	sa := raddr.sockaddr()
 	// Retry connect in a loop if EINTR is encountered.
 	for {
-		if ret, errno := C.connect_sockaddr_hv(C.int(fd), &sa); ret != 0 {
-			if errno == syscall.EINTR {
-				continue
-			}
-			return nil, fmt.Errorf("connect(%s) failed with %d, errno=%d", raddr, ret, errno)
+		_, _, e1 := unix.Syscall(unix.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(sa)), uintptr(sizeofSockaddrHyperv))
+		if e1 == syscall.EINTR {
+			continue
+		}
+		if e1 != 0 {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("connect(%s) failed: %w", raddr, e1)
 		}
 		break
 	}
 
-	return newHVsockConn(uintptr(fd), &Addr{VMID: GUIDZero, ServiceID: GUIDZero}, &raddr), nil
+	return newHVsockConn(fd, &Addr{VMID: GUIDZero, ServiceID: GUIDZero}, &raddr, msgSize)
 }
 
-// Listen returns a net.Listener which can accept connections on the given port
-func Listen(addr Addr) (net.Listener, error) {
-	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM, hvsockRaw)
+func listen(addr Addr, msgSize int) (net.Listener, error) {
+	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, hvsockRaw)
 	if err != nil {
 		return nil, err
 	}
 
-	sa := C.struct_sockaddr_hv{}
-	sa.shv_family = hvsockAF
-	sa.reserved = 0
-
-	for i := 0; i < 16; i++ {
-		sa.shv_vm_id[i] = C.uchar(addr.VMID[i])
-	}
-	for i := 0; i < 16; i++ {
-		sa.shv_service_id[i] = C.uchar(addr.ServiceID[i])
-	}
-
-	if ret, errno := C.bind_sockaddr_hv(C.int(fd), &sa); ret != 0 {
-		return nil, fmt.Errorf("listen(%s) failed with %d, errno=%d", addr, ret, errno)
+	sa := addr.sockaddr()
+	_, _, e1 := unix.RawSyscall(unix.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(sa)), uintptr(sizeofSockaddrHyperv))
+	if e1 != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("listen(%s) failed: %w", addr, e1)
 	}
 
 	err = syscall.Listen(fd, syscall.SOMAXCONN)
 	if err != nil {
+		syscall.Close(fd)
 		return nil, fmt.Errorf("listen(%s) failed: %w", addr, err)
 	}
-	return &hvsockListener{fd, addr}, nil
+
+	// Like connections, the listener is non-blocking and registered
+	// with the runtime poller so that Close wakes up a pending Accept.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set fd %d non-blocking: %w", fd, err)
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("hvsock:%d", fd))
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &hvsockListener{file: f, rc: rc, local: addr, msgSize: msgSize}, nil
 }
 
 //
@@ -144,29 +142,41 @@ func Listen(addr Addr) (net.Listener, error) {
 //
 
 type hvsockListener struct {
-	fd    int
-	local Addr
+	file    *os.File
+	rc      syscall.RawConn
+	local   Addr
+	msgSize int
 }
 
 // Accept accepts an incoming call and returns the new connection.
 func (v *hvsockListener) Accept() (net.Conn, error) {
-	var acceptSA C.struct_sockaddr_hv
-	var acceptSALen C.socklen_t
-
-	acceptSALen = C.sizeof_struct_sockaddr_hv
-	fd, err := C.accept_hv(C.int(v.fd), &acceptSA, &acceptSALen)
+	var sa rawSockaddrHyperv
+	var nfd uintptr
+	var e1 syscall.Errno
+	err := v.rc.Read(func(fd uintptr) bool {
+		for {
+			saLen := uint32(sizeofSockaddrHyperv)
+			nfd, _, e1 = unix.Syscall6(unix.SYS_ACCEPT4, fd, uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&saLen)), syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, 0, 0)
+			if e1 != syscall.EINTR && e1 != syscall.ECONNABORTED {
+				return e1 != syscall.EAGAIN
+			}
+		}
+	})
 	if err != nil {
-		return nil, fmt.Errorf("accept(%s) failed: %w", v.local, err)
+		return nil, fmt.Errorf("accept(%s) failed: %w", v.local, rawConnError(err))
+	}
+	if e1 != 0 {
+		return nil, fmt.Errorf("accept(%s) failed: %w", v.local, e1)
 	}
 
-	remote := &Addr{VMID: guidFromC(acceptSA.shv_vm_id), ServiceID: guidFromC(acceptSA.shv_service_id)}
-	return newHVsockConn(uintptr(fd), &v.local, remote), nil
+	remote := &Addr{VMID: sa.VMID, ServiceID: sa.ServiceID}
+	return newHVsockConn(int(nfd), &v.local, remote, v.msgSize)
 }
 
-// Close closes the listening connection
+// Close closes the listening connection. A pending Accept returns
+// net.ErrClosed.
 func (v *hvsockListener) Close() error {
-	// Note this won't cause the Accept to unblock.
-	return unix.Close(v.fd)
+	return mapError(v.file.Close())
 }
 
 // Addr returns the address the Listener is listening on
@@ -181,14 +191,23 @@ func (v *hvsockListener) Addr() net.Addr {
 // hvsockConn represents a connection over a Hyper-V socket
 type hvsockConn struct {
 	hvsock *os.File
-	fd     uintptr
 	local  *Addr
 	remote *Addr
+	// msgSize limits the size of send calls, 0 means unlimited
+	msgSize int
 }
 
-func newHVsockConn(fd uintptr, local, remote *Addr) *hvsockConn {
-	hvsock := os.NewFile(fd, fmt.Sprintf("hvsock:%d", fd))
-	return &hvsockConn{hvsock: hvsock, fd: fd, local: local, remote: remote}
+// newHVsockConn wraps fd in a hvsockConn which sends at most msgSize
+// bytes at a time (0 for unlimited). The fd is put into
+// non-blocking mode so that os.NewFile registers it with the runtime
+// poller. On error fd is closed.
+func newHVsockConn(fd int, local, remote *Addr, msgSize int) (*hvsockConn, error) {
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set fd %d non-blocking: %w", fd, err)
+	}
+	hvsock := os.NewFile(uintptr(fd), fmt.Sprintf("hvsock:%d", fd))
+	return &hvsockConn{hvsock: hvsock, local: local, remote: remote, msgSize: msgSize}, nil
 }
 
 // LocalAddr returns the local address of a connection
@@ -201,36 +220,56 @@ func (v *hvsockConn) RemoteAddr() net.Addr {
 	return v.remote
 }
 
-// Close closes the connection
+// Close closes the connection. Pending Read and Write calls return
+// net.ErrClosed.
 func (v *hvsockConn) Close() error {
-	return v.hvsock.Close()
+	return mapError(v.hvsock.Close())
 }
 
 // CloseRead shuts down the reading side of a hvsock connection
 func (v *hvsockConn) CloseRead() error {
-	return syscall.Shutdown(int(v.fd), syscall.SHUT_RD)
+	return v.shutdown(syscall.SHUT_RD)
 }
 
 // CloseWrite shuts down the writing side of a hvsock connection
 func (v *hvsockConn) CloseWrite() error {
-	return syscall.Shutdown(int(v.fd), syscall.SHUT_WR)
+	return v.shutdown(syscall.SHUT_WR)
 }
 
-// Read reads data from the connection
+// shutdown calls shutdown(2) on the socket unless the connection has
+// been closed, in which case the fd may already have been reused.
+func (v *hvsockConn) shutdown(how int) error {
+	rc, err := v.hvsock.SyscallConn()
+	if err != nil {
+		return mapError(err)
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.Shutdown(int(fd), how)
+	}); err != nil {
+		return rawConnError(err)
+	}
+	return serr
+}
+
+// Read reads data from the connection. If the read deadline expires
+// it returns ErrTimeout.
 func (v *hvsockConn) Read(buf []byte) (int, error) {
-	return v.hvsock.Read(buf)
+	n, err := v.hvsock.Read(buf)
+	return n, mapError(err)
 }
 
-// Write writes data over the connection
-// TODO(rn): replace with a straight call to v.hvsock.Write() once 4.9.x support is deprecated
+// Write writes data over the connection, split into send calls of at
+// most the connection's maximum message size. If the write deadline
+// expires it returns ErrTimeout.
 func (v *hvsockConn) Write(buf []byte) (int, error) {
 	written := 0
 	toWrite := len(buf)
 	for toWrite > 0 {
-		thisBatch := min(toWrite, maxMsgSize)
+		thisBatch := chunk(toWrite, v.msgSize)
 		n, err := v.hvsock.Write(buf[written : written+thisBatch])
 		if err != nil {
-			return written, err
+			return written + n, mapError(err)
 		}
 		if n != thisBatch {
 			return written, fmt.Errorf("short write %d != %d", n, thisBatch)
@@ -244,33 +283,68 @@ func (v *hvsockConn) Write(buf []byte) (int, error) {
 
 // SetDeadline sets the read and write deadlines associated with the connection
 func (v *hvsockConn) SetDeadline(t time.Time) error {
-	return nil // FIXME
+	return mapError(v.hvsock.SetDeadline(t))
 }
 
 // SetReadDeadline sets the deadline for future Read calls.
 func (v *hvsockConn) SetReadDeadline(t time.Time) error {
-	return nil // FIXME
+	return mapError(v.hvsock.SetReadDeadline(t))
 }
 
 // SetWriteDeadline sets the deadline for future Write calls
 func (v *hvsockConn) SetWriteDeadline(t time.Time) error {
-	return nil // FIXME
+	return mapError(v.hvsock.SetWriteDeadline(t))
+}
+
+// SyscallConn returns a raw network connection. It implements the
+// syscall.Conn interface. The returned RawConn is integrated with the
+// runtime poller.
+func (v *hvsockConn) SyscallConn() (syscall.RawConn, error) {
+	return v.hvsock.SyscallConn()
 }
 
 // File duplicates the underlying socket descriptor and returns it.
 func (v *hvsockConn) File() (*os.File, error) {
+	rc, err := v.hvsock.SyscallConn()
+	if err != nil {
+		return nil, mapError(err)
+	}
 	// This is equivalent to dup(2) but creates the new fd with CLOEXEC already set.
-	r0, _, e1 := syscall.Syscall(syscall.SYS_FCNTL, uintptr(v.hvsock.Fd()), syscall.F_DUPFD_CLOEXEC, 0)
+	// Note: v.hvsock.Fd() is not used as it would put the socket back into blocking mode.
+	var r0 uintptr
+	var e1 syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		r0, _, e1 = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_DUPFD_CLOEXEC, 0)
+	}); err != nil {
+		return nil, rawConnError(err)
+	}
 	if e1 != 0 {
 		return nil, os.NewSyscallError("fcntl", e1)
 	}
 	return os.NewFile(r0, v.hvsock.Name()), nil
 }
 
-func guidFromC(cg [16]C.uchar) GUID {
-	var g GUID
-	for i := 0; i < 16; i++ {
-		g[i] = byte(cg[i])
+// mapError converts the errors of the *os.File wrapping a socket into
+// those of a network connection: an expired deadline becomes
+// ErrTimeout and use of a closed socket net.ErrClosed.
+func mapError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrTimeout
+	case errors.Is(err, os.ErrClosed):
+		return net.ErrClosed
+	}
+	return err
+}
+
+// rawConnError maps an error returned by a syscall.RawConn method
+// itself, rather than by the function passed to it. The runtime poller
+// only fails if the deadline expired or the file has been closed.
+func rawConnError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrTimeout
 	}
-	return g
+	return net.ErrClosed
 }
@@ -0,0 +1,121 @@
+package hvsock
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGUIDFromString(t *testing.T) {
+	const canonical = "a42e7cda-d03f-480c-9cc2-a4de20abb878"
+	for _, tc := range []struct {
+		in string
+		ok bool
+	}{
+		{canonical, true},
+		{"{" + canonical + "}", true},
+		{"A42E7CDA-D03F-480C-9CC2-A4DE20ABB878", true},
+		{"{A42E7CDA-D03F-480C-9CC2-A4DE20ABB878}", true},
+		{"", false},
+		{"a42e7cda-d03f-480c-9cc2-a4de20abb87", false},   // short
+		{"a42e7cda-d03f-480c-9cc2-a4de20abb8788", false}, // long
+		{canonical + "junk", false},
+		{canonical + " ", false},
+		{"{" + canonical, false},
+		{canonical + "}", false},
+		{"{" + canonical + "}}", false},
+		{"a42e7cda+d03f-480c-9cc2-a4de20abb878", false},
+		{"a42e7cdad03f-480c-9cc2-a4de20abb878-", false},
+		{"g42e7cda-d03f-480c-9cc2-a4de20abb878", false},
+	} {
+		g, err := GUIDFromString(tc.in)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("GUIDFromString(%q) = %s, want error", tc.in, g)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("GUIDFromString(%q): %v", tc.in, err)
+			continue
+		}
+		if g != GUIDParent {
+			t.Errorf("GUIDFromString(%q) = %s, want %s", tc.in, g, GUIDParent)
+		}
+		if s := g.String(); s != canonical {
+			t.Errorf("GUIDFromString(%q).String() = %s, want %s", tc.in, s, canonical)
+		}
+	}
+}
+
+func TestGUIDPort(t *testing.T) {
+	for _, port := range []uint32{0, 1, 1024, 0x5653, 0x7fffffff, 0xffffffff} {
+		g := GUIDFromPort(port)
+		got, err := g.Port()
+		if err != nil {
+			t.Errorf("GUIDFromPort(%#x).Port(): %v", port, err)
+			continue
+		}
+		if got != port {
+			t.Errorf("GUIDFromPort(%#x).Port() = %#x", port, got)
+		}
+	}
+
+	g, err := GUIDFromString("00000400-facb-11e6-bd58-64006a7986d3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g != GUIDFromPort(1024) {
+		t.Errorf("GUIDFromPort(1024) = %s, want %s", GUIDFromPort(1024), g)
+	}
+
+	for _, g := range []GUID{GUIDZero, GUIDParent, GUIDLoopback} {
+		if port, err := g.Port(); err == nil {
+			t.Errorf("%s.Port() = %#x, want error", g, port)
+		}
+	}
+}
+
+func TestGUIDMarshal(t *testing.T) {
+	type config struct {
+		Service GUID
+	}
+	in := config{Service: GUIDFromPort(1024)}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if want := `{"Service":"00000400-facb-11e6-bd58-64006a7986d3"}`; string(b) != want {
+		t.Errorf("Marshal: got %s, want %s", b, want)
+	}
+
+	var out config
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !out.Service.Equal(in.Service) {
+		t.Errorf("Unmarshal: got %s, want %s", out.Service, in.Service)
+	}
+	if err := json.Unmarshal([]byte(`{"Service":"00000400-facb-11e6"}`), &out); err == nil {
+		t.Error("Unmarshal of a short GUID succeeded")
+	}
+}
+
+func TestNewGUID(t *testing.T) {
+	g, err := NewGUID()
+	if err != nil {
+		t.Fatalf("NewGUID: %v", err)
+	}
+	if g.IsZero() {
+		t.Error("NewGUID returned the zero GUID")
+	}
+	if s := g.String(); s[14] != '4' {
+		t.Errorf("NewGUID: %s is not a version 4 GUID", s)
+	}
+	h, err := NewGUID()
+	if err != nil {
+		t.Fatalf("NewGUID: %v", err)
+	}
+	if g.Equal(h) {
+		t.Errorf("NewGUID returned %s twice", g)
+	}
+}
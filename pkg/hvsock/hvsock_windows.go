@@ -27,9 +27,6 @@ const (
 )
 
 var (
-	// ErrTimeout is an error returned on timeout
-	ErrTimeout = &timeoutError{}
-
 	wsaData syscall.WSAData
 )
 
@@ -38,8 +35,46 @@ func Supported() bool {
 	return true
 }
 
-// Dial a Hyper-V socket address
-func Dial(raddr Addr) (Conn, error) {
+const (
+	// unlimitedMsgSizeBuild is the first Windows build on which
+	// writes are not split into maxMsgSize chunks by default. Linux
+	// VMs on older hosts may still run 4.9.x kernels with the legacy
+	// Hyper-V socket implementation.
+	unlimitedMsgSizeBuild = 17763 // 1809, aka Redstone 5
+)
+
+var (
+	msgSizeOnce    sync.Once
+	msgSizeDefault int
+)
+
+// osVersionInfo is RTL_OSVERSIONINFOW
+type osVersionInfo struct {
+	OSVersionInfoSize uint32
+	MajorVersion      uint32
+	MinorVersion      uint32
+	BuildNumber       uint32
+	PlatformID        uint32
+	CSDVersion        [128]uint16
+}
+
+// defaultMsgSize returns the default limit on the size of send calls.
+// It is maxMsgSize on Windows builds before unlimitedMsgSizeBuild and
+// unlimited on newer ones.
+func defaultMsgSize() int {
+	msgSizeOnce.Do(func() {
+		msgSizeDefault = maxMsgSize
+		// RtlGetVersion, unlike GetVersion, reports the real
+		// version regardless of the application manifest.
+		info := osVersionInfo{OSVersionInfoSize: uint32(unsafe.Sizeof(osVersionInfo{}))}
+		if rtlGetVersion(&info) == 0 && info.BuildNumber >= unlimitedMsgSizeBuild {
+			msgSizeDefault = 0
+		}
+	})
+	return msgSizeDefault
+}
+
+func dial(raddr Addr, msgSize int) (Conn, error) {
 	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM, hvsockRaw)
 	if err != nil {
 		return nil, err
@@ -55,11 +90,10 @@ func Dial(raddr Addr) (Conn, error) {
 		return nil, fmt.Errorf("connect(%s) failed: %w", raddr, err)
 	}
 
-	return newHVsockConn(fd, Addr{VMID: GUIDZero, ServiceID: GUIDZero}, raddr)
+	return newHVsockConn(fd, Addr{VMID: GUIDZero, ServiceID: GUIDZero}, raddr, msgSize)
 }
 
-// Listen returns a net.Listener which can accept connections on the given port
-func Listen(addr Addr) (net.Listener, error) {
+func listen(addr Addr, msgSize int) (net.Listener, error) {
 	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM, hvsockRaw)
 	if err != nil {
 		return nil, err
@@ -79,7 +113,7 @@ func Listen(addr Addr) (net.Listener, error) {
 		return nil, fmt.Errorf("listen(%s) failed: %w", addr, err)
 	}
 
-	return &hvsockListener{fd, addr}, nil
+	return &hvsockListener{fd, addr, msgSize}, nil
 }
 
 //
@@ -87,8 +121,9 @@ func Listen(addr Addr) (net.Listener, error) {
 //
 
 type hvsockListener struct {
-	fd    syscall.Handle
-	local Addr
+	fd      syscall.Handle
+	local   Addr
+	msgSize int
 }
 
 // Accept accepts an incoming call and returns the new connection
@@ -108,7 +143,7 @@ func (v *hvsockListener) Accept() (net.Conn, error) {
 	for i := 0; i < len(raddr.ServiceID); i++ {
 		raddr.ServiceID[i] = sa.ServiceID[i]
 	}
-	return newHVsockConn(fd, v.local, raddr)
+	return newHVsockConn(fd, v.local, raddr, v.msgSize)
 }
 
 // Close closes the listening connection
@@ -130,6 +165,8 @@ type hvsockConn struct {
 	fd     syscall.Handle
 	local  Addr
 	remote Addr
+	// msgSize limits the size of send calls, 0 means unlimited
+	msgSize int
 
 	wg      sync.WaitGroup
 	wgLock  sync.RWMutex
@@ -139,9 +176,9 @@ type hvsockConn struct {
 	writeDeadline deadlineHandler
 }
 
-func newHVsockConn(h syscall.Handle, local Addr, remote Addr) (*hvsockConn, error) {
+func newHVsockConn(h syscall.Handle, local Addr, remote Addr, msgSize int) (*hvsockConn, error) {
 	ioInitOnce.Do(initIo)
-	v := &hvsockConn{fd: h, local: local, remote: remote}
+	v := &hvsockConn{fd: h, local: local, remote: remote, msgSize: msgSize}
 
 	_, err := createIoCompletionPort(h, ioCompletionPort, 0, 0xffffffff)
 	if err != nil {
@@ -217,13 +254,13 @@ func (v *hvsockConn) Read(buf []byte) (int, error) {
 	}
 }
 
-// Write writes data over the connection
-// TODO(rn): Remove once 4.9.x support is deprecated
+// Write writes data over the connection, split into send calls of at
+// most the connection's maximum message size.
 func (v *hvsockConn) Write(buf []byte) (int, error) {
 	written := 0
 	toWrite := len(buf)
 	for toWrite > 0 {
-		thisBatch := min(toWrite, maxMsgSize)
+		thisBatch := chunk(toWrite, v.msgSize)
 		n, err := v.write(buf[written : written+thisBatch])
 		if err != nil {
 			return written, err
@@ -285,6 +322,39 @@ func (v *hvsockConn) SetDeadline(deadline time.Time) error {
 	return v.SetWriteDeadline(deadline)
 }
 
+// SyscallConn returns a raw network connection. It implements the
+// syscall.Conn interface. Only Control is supported as all I/O on
+// Hyper-V sockets is performed using overlapped I/O.
+func (v *hvsockConn) SyscallConn() (syscall.RawConn, error) {
+	return &rawConn{v}, nil
+}
+
+// rawConn implements syscall.RawConn for a hvsockConn
+type rawConn struct {
+	v *hvsockConn
+}
+
+// Control invokes f on the underlying socket handle
+func (c *rawConn) Control(f func(fd uintptr)) error {
+	c.v.wgLock.RLock()
+	defer c.v.wgLock.RUnlock()
+	if c.v.closing.isSet() {
+		return fmt.Errorf("HvSocket has already been closed")
+	}
+	f(uintptr(c.v.fd))
+	return nil
+}
+
+// Read is not supported for Hyper-V sockets
+func (c *rawConn) Read(f func(fd uintptr) bool) error {
+	return syscall.EWINDOWS
+}
+
+// Write is not supported for Hyper-V sockets
+func (c *rawConn) Write(f func(fd uintptr) bool) error {
+	return syscall.EWINDOWS
+}
+
 // Helper functions for conversion to sockaddr
 
 // struck sockaddr equivalent
@@ -333,12 +403,6 @@ func (b *atomicBool) swap(new bool) bool {
 	return atomic.SwapInt32((*int32)(b), newInt) == 1
 }
 
-type timeoutError struct{}
-
-func (e *timeoutError) Error() string   { return "i/o timeout" }
-func (e *timeoutError) Timeout() bool   { return true }
-func (e *timeoutError) Temporary() bool { return true }
-
 type timeoutChan chan struct{}
 
 var ioInitOnce sync.Once
@@ -0,0 +1,50 @@
+package hvsock
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"github.com/linuxkit/virtsock/internal/writev"
+)
+
+// Writev writes the buffers in bufs to the connection using writev(2).
+// Like Write, no single system call writes more than the connection's
+// maximum message size, but small buffers, such as a header and a
+// body, are sent together.
+// It returns the number of bytes written. bufs is not modified.
+func (v *hvsockConn) Writev(bufs [][]byte) (int64, error) {
+	b := net.Buffers(append([][]byte(nil), bufs...))
+	return v.writeBuffers(&b)
+}
+
+// ReadFrom implements io.ReaderFrom. If r is a *net.Buffers it is
+// written with Writev and consumed, otherwise it is copied with
+// io.Copy.
+//
+// net.Buffers.WriteTo only uses writev(2) for the standard library's
+// own connection types, so call ReadFrom or Writev directly.
+func (v *hvsockConn) ReadFrom(r io.Reader) (int64, error) {
+	if b, ok := r.(*net.Buffers); ok {
+		return v.writeBuffers(b)
+	}
+	// Hide ReadFrom so io.Copy does not call it recursively
+	return io.Copy(struct{ io.Writer }{v}, r)
+}
+
+// writeBuffers writes the buffers in b with writev(2), in system calls
+// of at most the maximum message size, and consumes what was written.
+func (v *hvsockConn) writeBuffers(b *net.Buffers) (int64, error) {
+	rc, err := v.hvsock.SyscallConn()
+	if err != nil {
+		return 0, mapError(err)
+	}
+	n, err := writev.Write(rc, *b, v.msgSize)
+	*b = writev.Consume(*b, n)
+	var serr *os.SyscallError
+	if err != nil && !errors.As(err, &serr) {
+		err = rawConnError(err)
+	}
+	return n, err
+}
@@ -0,0 +1,68 @@
+package hvsock
+
+import (
+	"net"
+)
+
+// DialOptions contains options for connecting to a Hyper-V socket
+// address. The zero value for each field is equivalent to dialing
+// without that option.
+type DialOptions struct {
+	// MaxMsgSize is the maximum number of bytes passed to a single
+	// send call. Larger writes are split up. If zero, the default
+	// of the platform is used (see defaultMsgSize); if negative,
+	// writes are never split.
+	MaxMsgSize int
+}
+
+// Dial connects to raddr using the options in o
+func (o *DialOptions) Dial(raddr Addr) (Conn, error) {
+	return dial(raddr, msgSize(o.MaxMsgSize))
+}
+
+// ListenOptions contains options for listening on a Hyper-V socket
+// address. The zero value for each field is equivalent to listening
+// without that option.
+type ListenOptions struct {
+	// MaxMsgSize is the maximum number of bytes passed to a single
+	// send call on accepted connections, see DialOptions.
+	MaxMsgSize int
+}
+
+// Listen listens on addr using the options in o
+func (o *ListenOptions) Listen(addr Addr) (net.Listener, error) {
+	return listen(addr, msgSize(o.MaxMsgSize))
+}
+
+// Dial a Hyper-V socket address
+func Dial(raddr Addr) (Conn, error) {
+	var o DialOptions
+	return o.Dial(raddr)
+}
+
+// Listen returns a net.Listener which can accept connections on the given port
+func Listen(addr Addr) (net.Listener, error) {
+	var o ListenOptions
+	return o.Listen(addr)
+}
+
+// msgSize converts the MaxMsgSize option to the limit used by
+// connections, where 0 means unlimited.
+func msgSize(n int) int {
+	switch {
+	case n < 0:
+		return 0
+	case n == 0:
+		return defaultMsgSize()
+	}
+	return n
+}
+
+// chunk returns the size of the next send call for toWrite bytes
+// given a limit as returned by msgSize.
+func chunk(toWrite, limit int) int {
+	if limit == 0 {
+		return toWrite
+	}
+	return min(toWrite, limit)
+}
@@ -36,6 +36,7 @@ var (
 	modws2_32   = syscall.NewLazyDLL("ws2_32.dll")
 	modwinmm    = syscall.NewLazyDLL("winmm.dll")
 	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+	modntdll    = syscall.NewLazyDLL("ntdll.dll")
 
 	procConnect = modws2_32.NewProc("connect")
 	procBind    = modws2_32.NewProc("bind")
@@ -46,6 +47,7 @@ var (
 	procGetQueuedCompletionStatus          = modkernel32.NewProc("GetQueuedCompletionStatus")
 	procSetFileCompletionNotificationModes = modkernel32.NewProc("SetFileCompletionNotificationModes")
 	proctimeBeginPeriod                    = modwinmm.NewProc("timeBeginPeriod")
+	procRtlGetVersion                      = modntdll.NewProc("RtlGetVersion")
 )
 
 // Do the interface allocations only once for common
@@ -169,3 +171,9 @@ func timeBeginPeriod(period uint32) (n int32) {
 	n = int32(r0)
 	return
 }
+
+func rtlGetVersion(info *osVersionInfo) (ntstatus uint32) {
+	r0, _, _ := syscall.Syscall(procRtlGetVersion.Addr(), 1, uintptr(unsafe.Pointer(info)), 0, 0)
+	ntstatus = uint32(r0)
+	return
+}
@@ -0,0 +1,110 @@
+package vsock
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// cidNames maps the well-known names accepted by ParseAddr to CIDs.
+var cidNames = map[string]uint32{
+	"any":        CIDAny,
+	"hypervisor": CIDHypervisor,
+	"local":      CIDLocal,
+	"loopback":   CIDLocal,
+	"host":       CIDHost,
+	"parent":     CIDHost,
+}
+
+// ParseAddr parses a vsock address. The following forms are accepted:
+//   - "cid:port" with a decimal CID and port, e.g. "3:1024"
+//   - the hexadecimal form returned by Addr.String(), e.g. "00000003.00000400"
+//   - a URL with the "vsock" scheme, e.g. "vsock://3:1024", whose host
+//     is parsed as one of the other forms. A path of "/" is ignored.
+//
+// Instead of a decimal CID the names "any", "hypervisor", "local",
+// "loopback", "host" and "parent" may be used. An empty CID is
+// equivalent to "any" and, except in URLs, the port may be given as
+// "any" for PortAny.
+func ParseAddr(s string) (Addr, error) {
+	str := s
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return Addr{}, fmt.Errorf("invalid vsock address %q: %w", s, err)
+		}
+		if u.Scheme != "vsock" {
+			return Addr{}, fmt.Errorf("invalid vsock address %q: unsupported scheme %q", s, u.Scheme)
+		}
+		if u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+			return Addr{}, fmt.Errorf("invalid vsock address %q: unexpected URL components", s)
+		}
+		str = u.Host
+	}
+
+	// Hex form as returned by String()
+	if len(str) == 17 && str[8] == '.' {
+		cid, err1 := strconv.ParseUint(str[:8], 16, 32)
+		port, err2 := strconv.ParseUint(str[9:], 16, 32)
+		if err1 == nil && err2 == nil {
+			return Addr{CID: uint32(cid), Port: uint32(port)}, nil
+		}
+	}
+
+	i := strings.LastIndex(str, ":")
+	if i < 0 {
+		return Addr{}, fmt.Errorf("invalid vsock address %q: missing port", s)
+	}
+	cid, err := parseCID(str[:i])
+	if err != nil {
+		return Addr{}, fmt.Errorf("invalid vsock address %q: %w", s, err)
+	}
+	port, err := parsePort(str[i+1:])
+	if err != nil {
+		return Addr{}, fmt.Errorf("invalid vsock address %q: %w", s, err)
+	}
+	return Addr{CID: cid, Port: port}, nil
+}
+
+func parseCID(s string) (uint32, error) {
+	if s == "" {
+		return CIDAny, nil
+	}
+	if cid, ok := cidNames[strings.ToLower(s)]; ok {
+		return cid, nil
+	}
+	cid, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CID %q", s)
+	}
+	return uint32(cid), nil
+}
+
+func parsePort(s string) (uint32, error) {
+	if strings.ToLower(s) == "any" {
+		return PortAny, nil
+	}
+	port, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint32(port), nil
+}
+
+// MarshalText implements encoding.TextMarshaler. The address is
+// formatted as by String().
+func (a Addr) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts all
+// the forms supported by ParseAddr.
+func (a *Addr) UnmarshalText(text []byte) error {
+	addr, err := ParseAddr(string(text))
+	if err != nil {
+		return err
+	}
+	*a = addr
+	return nil
+}
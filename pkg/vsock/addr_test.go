@@ -0,0 +1,89 @@
+package vsock
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Addr
+		ok   bool
+	}{
+		{"3:1024", Addr{3, 1024}, true},
+		{"00000003.00000400", Addr{3, 1024}, true},
+		{"ffffffff.ffffffff", Addr{CIDAny, PortAny}, true},
+		{"vsock://3:1024", Addr{3, 1024}, true},
+		{"vsock://3:1024/", Addr{3, 1024}, true},
+		{"VSOCK://3:1024", Addr{3, 1024}, true},
+		{"vsock://host:1024", Addr{CIDHost, 1024}, true},
+		{"vsock://:1235", Addr{CIDAny, 1235}, true},
+		{"vsock://00000002.00000400", Addr{CIDHost, 1024}, true},
+		{":1024", Addr{CIDAny, 1024}, true},
+		{"any:any", Addr{CIDAny, PortAny}, true},
+		{"host:1024", Addr{CIDHost, 1024}, true},
+		{"HOST:1024", Addr{CIDHost, 1024}, true},
+		{"parent:1024", Addr{CIDHost, 1024}, true},
+		{"hypervisor:1024", Addr{CIDHypervisor, 1024}, true},
+		{"local:1024", Addr{CIDLocal, 1024}, true},
+		{"loopback:1024", Addr{CIDLocal, 1024}, true},
+		{"4294967295:4294967295", Addr{CIDAny, PortAny}, true},
+
+		{"", Addr{}, false},
+		{"3", Addr{}, false},
+		{"3:", Addr{}, false},
+		{"3:1024/", Addr{}, false},
+		{"3:0x400", Addr{}, false},
+		{"3:-1", Addr{}, false},
+		{"4294967296:1024", Addr{}, false},
+		{"3:4294967296", Addr{}, false},
+		{"guest:1024", Addr{}, false},
+		{"00000003.0000040g", Addr{}, false},
+		{"vsock://3", Addr{}, false},
+		{"vsock://3:1024/path", Addr{}, false},
+		{"vsock://3:1024?x=1", Addr{}, false},
+		{"vsock://3:any", Addr{}, false},
+		{"tcp://3:1024", Addr{}, false},
+	} {
+		got, err := ParseAddr(tc.in)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("ParseAddr(%q) = %s, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAddr(%q): %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseAddr(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAddrText(t *testing.T) {
+	type config struct {
+		Addr Addr
+	}
+	in := config{Addr{CIDHost, 1024}}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if want := `{"Addr":"00000002.00000400"}`; string(b) != want {
+		t.Errorf("Marshal: got %s, want %s", b, want)
+	}
+
+	var out config
+	if err := json.Unmarshal([]byte(`{"Addr":"vsock://host:1024"}`), &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if out != in {
+		t.Errorf("Unmarshal: got %s, want %s", out.Addr, in.Addr)
+	}
+	if err := json.Unmarshal([]byte(`{"Addr":"host"}`), &out); err == nil {
+		t.Error("Unmarshal of an address without port succeeded")
+	}
+}
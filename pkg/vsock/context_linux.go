@@ -0,0 +1,119 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// afterDone calls f in a new goroutine once ctx is done, unless the
+// returned stop function is called first. stop waits for a running f
+// to return and reports whether f was called.
+func afterDone(ctx context.Context, f func()) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	called := false
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			f()
+			called = true
+		case <-done:
+		}
+	}()
+	return func() bool {
+		close(done)
+		<-exited
+		return called
+	}
+}
+
+// interruptOnDone forces a pending blocking call to return once ctx
+// is done, by passing a time in the past to setDeadline. The returned
+// function must be called once the call has returned; if the deadline
+// was set it is cleared again.
+func interruptOnDone(ctx context.Context, setDeadline func(time.Time) error) (stop func()) {
+	stopped := afterDone(ctx, func() {
+		_ = setDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		if stopped() {
+			_ = setDeadline(time.Time{})
+		}
+	}
+}
+
+// sharedDeadline coordinates the callers of AcceptContext on a
+// listener, which borrow the listener's deadline to interrupt Accept
+// when their context is done. Setting the deadline also wakes up every
+// other caller blocked in Accept; retry tells them to try again. The
+// zero value is ready to use.
+type sharedDeadline struct {
+	mu      sync.Mutex
+	expired int           // callers which set the deadline and have not cleared it yet
+	gen     uint64        // incremented whenever the deadline is set
+	cleared chan struct{} // closed once expired drops back to zero
+}
+
+// generation returns the value to pass to retry after the blocking
+// call.
+func (d *sharedDeadline) generation() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.gen
+}
+
+// interruptOnDone is like the function of the same name, but the
+// deadline is only cleared once the contexts of all the callers which
+// set it have been dealt with.
+func (d *sharedDeadline) interruptOnDone(ctx context.Context, setDeadline func(time.Time) error) (stop func()) {
+	stopped := afterDone(ctx, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.expired == 0 {
+			d.cleared = make(chan struct{})
+		}
+		d.expired++
+		d.gen++
+		_ = setDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		if !stopped() {
+			return
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.expired--; d.expired == 0 {
+			_ = setDeadline(time.Time{})
+			close(d.cleared)
+		}
+	}
+}
+
+// retry reports whether err is a timeout caused by another caller
+// having set the deadline since gen was returned by generation, or
+// having it still set. If so, it waits for the deadline to be cleared
+// or for ctx to be done before returning.
+func (d *sharedDeadline) retry(ctx context.Context, err error, gen uint64) bool {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	d.mu.Lock()
+	borrowed := d.gen != gen || d.expired > 0
+	cleared := d.cleared
+	d.mu.Unlock()
+	if !borrowed {
+		return false
+	}
+	select {
+	case <-cleared:
+	case <-ctx.Done():
+	}
+	return true
+}
@@ -1,24 +1,87 @@
+//go:build !linux && !darwin
 // +build !linux,!darwin
 
 package vsock
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net"
+	"os"
 )
 
 // SocketMode is the unimplemented fallback for unsupported OSes
-func SocketMode(socketMode string) {
-	log.Fatalln("Unimplemented")
+func SocketMode(socketMode string) error {
+	return fmt.Errorf("Unimplemented")
 }
 
+// dialContext is the unimplemented fallback for unsupported OSes
+func dialContext(ctx context.Context, d *Dialer, cid, port uint32) (Conn, error) {
+	return nil, fmt.Errorf("Unimplemented")
+}
+
+// fallbackTransport is the unimplemented Transport for unsupported OSes
+type fallbackTransport struct{}
+
+// nativeTransport is the default value of DefaultTransport
+var nativeTransport = fallbackTransport{}
+
 // Dial is the unimplemented fallback for unsupported OSes
-func Dial(cid, port uint32) (Conn, error) {
+func (fallbackTransport) Dial(cid, port uint32) (Conn, error) {
+	return nil, fmt.Errorf("Unimplemented")
+}
+
+// DialContext is the unimplemented fallback for unsupported OSes
+func (fallbackTransport) DialContext(ctx context.Context, cid, port uint32) (Conn, error) {
 	return nil, fmt.Errorf("Unimplemented")
 }
 
 // Listen is the unimplemented fallback for unsupported OSes
-func Listen(cid, port uint32) (net.Listener, error) {
+func (fallbackTransport) Listen(cid, port uint32) (net.Listener, error) {
+	return nil, fmt.Errorf("Unimplemented")
+}
+
+// Name returns "unimplemented"
+func (fallbackTransport) Name() string {
+	return "unimplemented"
+}
+
+// listenConfig is the unimplemented fallback for unsupported OSes
+func listenConfig(lc *ListenConfig, cid, port uint32) (net.Listener, error) {
+	return nil, fmt.Errorf("Unimplemented")
+}
+
+// ListenPacket is the unimplemented fallback for unsupported OSes
+func ListenPacket(cid, port uint32) (PacketConn, error) {
+	return nil, fmt.Errorf("Unimplemented")
+}
+
+// DialPacket is the unimplemented fallback for unsupported OSes
+func DialPacket(cid, port uint32) (PacketConn, error) {
+	return nil, fmt.Errorf("Unimplemented")
+}
+
+// DialSeqPacket is the unimplemented fallback for unsupported OSes
+func DialSeqPacket(cid, port uint32) (SeqPacketConn, error) {
+	return nil, fmt.Errorf("Unimplemented")
+}
+
+// ListenSeqPacket is the unimplemented fallback for unsupported OSes
+func ListenSeqPacket(cid, port uint32) (net.Listener, error) {
+	return nil, fmt.Errorf("Unimplemented")
+}
+
+// ContextID is the unimplemented fallback for unsupported OSes
+func ContextID() (uint32, error) {
+	return 0, fmt.Errorf("Unimplemented")
+}
+
+// FileListener is the unimplemented fallback for unsupported OSes
+func FileListener(f *os.File) (net.Listener, error) {
+	return nil, fmt.Errorf("Unimplemented")
+}
+
+// FileConn is the unimplemented fallback for unsupported OSes
+func FileConn(f *os.File) (Conn, error) {
 	return nil, fmt.Errorf("Unimplemented")
 }
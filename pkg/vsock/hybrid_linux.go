@@ -0,0 +1,225 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// HybridTransport provides host side access to the vsock device of a
+// Firecracker or Cloud Hypervisor VM. These VMMs expose the guest's
+// vsock device as a Unix domain socket on the host ("hybrid vsock"):
+//   - Host to guest connections are made by connecting to Path and
+//     sending "CONNECT <port>\n". The VMM replies "OK <hostport>\n"
+//     once the guest has accepted the connection.
+//   - Guest to host connections to port P are forwarded by the VMM to
+//     a Unix domain socket at "<Path>_<P>" on which the host listens.
+type HybridTransport struct {
+	// Path is the Unix domain socket of the VMM's vsock device
+	// (uds_path in Firecracker, the socket of --vsock in Cloud
+	// Hypervisor).
+	Path string
+	// CID is the CID of the guest as configured in the VMM.
+	CID uint32
+}
+
+// Dial connects to the given port of the guest. cid must be the CID
+// of the guest.
+func (t *HybridTransport) Dial(cid, port uint32) (Conn, error) {
+	return t.DialContext(context.Background(), cid, port)
+}
+
+// DialContext connects to the given port of the guest. cid must be
+// the CID of the guest. If ctx expires before the guest accepts the
+// connection, the attempt is abandoned.
+func (t *HybridTransport) DialContext(ctx context.Context, cid, port uint32) (Conn, error) {
+	remote := &Addr{CID: cid, Port: port}
+	if cid != t.CID {
+		return nil, opError("dial", nil, remote, syscall.EHOSTUNREACH)
+	}
+
+	var nd net.Dialer
+	c, err := nd.DialContext(ctx, "unix", t.Path)
+	if err != nil {
+		return nil, opError("dial", nil, remote, err)
+	}
+	uc := c.(*net.UnixConn)
+
+	hostPort, err := hybridConnect(ctx, uc, port)
+	if err != nil {
+		uc.Close()
+		return nil, opError("dial", nil, remote, err)
+	}
+	return &hybridConn{
+		UnixConn: uc,
+		local:    &Addr{CID: CIDHost, Port: hostPort},
+		remote:   remote,
+	}, nil
+}
+
+// hybridConnect performs the CONNECT handshake on c and returns the
+// host side port assigned by the VMM.
+func hybridConnect(ctx context.Context, c *net.UnixConn, port uint32) (uint32, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	stop := interruptOnDone(ctx, c.SetDeadline)
+	defer stop()
+
+	if _, err := fmt.Fprintf(c, "CONNECT %d\n", port); err != nil {
+		return 0, ctxErr(ctx, err)
+	}
+
+	// Read the reply a byte at a time so no data sent by the guest
+	// right after the reply is consumed.
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := c.Read(b); err != nil {
+			if err == io.EOF {
+				// The VMM closes the connection if nothing
+				// listens on the port in the guest.
+				return 0, syscall.ECONNREFUSED
+			}
+			return 0, ctxErr(ctx, err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) > 64 {
+			return 0, fmt.Errorf("invalid reply to CONNECT: %q", line)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) != 2 || fields[0] != "OK" {
+		return 0, fmt.Errorf("invalid reply to CONNECT: %q", line)
+	}
+	hostPort, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid reply to CONNECT: %q", line)
+	}
+	return uint32(hostPort), nil
+}
+
+// ctxErr returns the error of ctx, if any, in preference to err. As
+// the connection's deadline is the one of ctx, it may expire before
+// ctx reports an error; the timeout is then reported as
+// context.DeadlineExceeded too.
+func ctxErr(ctx context.Context, err error) error {
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	}
+	if _, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// Listen listens for connections from the guest to the given port on
+// the host. cid must be CIDHost or CIDAny. The listener is the Unix
+// domain socket "<Path>_<port>"; a stale socket at that path, which
+// nothing listens on, is replaced.
+//
+// The remote address of accepted connections has the CID of the guest
+// and port PortAny, as the VMM does not pass on the guest's port.
+func (t *HybridTransport) Listen(cid, port uint32) (net.Listener, error) {
+	local := &Addr{CID: CIDHost, Port: port}
+	if cid != CIDHost && cid != CIDAny {
+		return nil, opError("listen", nil, &Addr{CID: cid, Port: port}, syscall.EADDRNOTAVAIL)
+	}
+	if port == 0 || port == PortAny {
+		return nil, opError("listen", nil, local, syscall.EINVAL)
+	}
+
+	sock := fmt.Sprintf("%s_%d", t.Path, port)
+	if err := removeStaleSocket(sock); err != nil {
+		return nil, opError("listen", nil, local, err)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		return nil, opError("listen", nil, local, err)
+	}
+	return &hybridListener{
+		UnixListener: l,
+		local:        *local,
+		remote:       &Addr{CID: t.CID, Port: PortAny},
+	}, nil
+}
+
+// Name returns "hybrid"
+func (t *HybridTransport) Name() string {
+	return "hybrid"
+}
+
+// hybridListener is a listener for guest initiated connections
+type hybridListener struct {
+	*net.UnixListener
+	local  Addr
+	remote *Addr
+
+	deadline sharedDeadline // borrowed by AcceptContext
+}
+
+// Accept accepts an incoming connection from the guest
+func (l *hybridListener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext accepts an incoming connection from the guest. If ctx
+// expires before a connection arrives, it returns the error of ctx.
+//
+// To interrupt the wait, AcceptContext borrows the deadline of the
+// listener, which also wakes up concurrent callers of Accept and
+// AcceptContext. These go back to waiting as long as their own context
+// is not done. A deadline set with SetDeadline is cleared when the
+// borrowed deadline is given back.
+func (l *hybridListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	for {
+		gen := l.deadline.generation()
+		stop := l.deadline.interruptOnDone(ctx, l.UnixListener.SetDeadline)
+		c, err := l.UnixListener.AcceptUnix()
+		stop()
+
+		if err == nil {
+			return &hybridConn{UnixConn: c, local: &l.local, remote: l.remote}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, opError("accept", nil, &l.local, ctx.Err())
+		}
+		if !l.deadline.retry(ctx, err, gen) {
+			return nil, err
+		}
+	}
+}
+
+// Addr returns the vsock address the listener is listening on
+func (l *hybridListener) Addr() net.Addr {
+	return l.local
+}
+
+// hybridConn is a connection via the VMM's Unix domain socket which
+// reports vsock addresses.
+type hybridConn struct {
+	*net.UnixConn
+	local, remote *Addr
+}
+
+// LocalAddr returns the host side vsock address of the connection
+func (c *hybridConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the guest side vsock address of the connection
+func (c *hybridConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,231 @@
+package vsock
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const (
+	testGuestCID = 3
+	testHostPort = 1073741824
+)
+
+// serveHybrid runs a stand-in for the VMM on path. CONNECT requests
+// for port 1234 are accepted, the connection then echoes what it
+// receives; requests for port 1 are never answered and requests for
+// port 2 get an invalid reply. The VMM closes the connection for all
+// other ports, as nothing listens on them in the guest.
+func serveHybrid(t *testing.T, path string) {
+	serveUnix(t, path, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch strings.TrimSpace(line) {
+		case "CONNECT 1234":
+			// Data sent by the guest right after the reply must
+			// not be lost.
+			fmt.Fprintf(c, "OK %d\nwelcome", testHostPort)
+			io.Copy(c, r)
+		case "CONNECT 1":
+			io.Copy(io.Discard, r)
+		case "CONNECT 2":
+			io.WriteString(c, "NOPE\n")
+		}
+	})
+}
+
+func TestHybridDial(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.sock")
+	serveHybrid(t, path)
+	tr := &HybridTransport{Path: path, CID: testGuestCID}
+
+	c, err := tr.Dial(testGuestCID, 1234)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	if got, want := c.LocalAddr().String(), (&Addr{CIDHost, testHostPort}).String(); got != want {
+		t.Errorf("LocalAddr: got %s, want %s", got, want)
+	}
+	if got, want := c.RemoteAddr().String(), (&Addr{testGuestCID, 1234}).String(); got != want {
+		t.Errorf("RemoteAddr: got %s, want %s", got, want)
+	}
+
+	if _, err := io.WriteString(c, " back"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := "welcome back"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHybridDialErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.sock")
+	serveHybrid(t, path)
+	tr := &HybridTransport{Path: path, CID: testGuestCID}
+
+	if _, err := tr.Dial(testGuestCID, 4321); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("Dial to port without listener: got %v, want ECONNREFUSED", err)
+	}
+	if _, err := tr.Dial(testGuestCID+1, 1234); !errors.Is(err, syscall.EHOSTUNREACH) {
+		t.Errorf("Dial to other CID: got %v, want EHOSTUNREACH", err)
+	}
+	if _, err := tr.Dial(testGuestCID, 2); err == nil || !strings.Contains(err.Error(), "invalid reply") {
+		t.Errorf("Dial with invalid reply: got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := tr.DialContext(ctx, testGuestCID, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext without reply: got %v, want context.DeadlineExceeded", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := tr.DialContext(ctx, testGuestCID, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled DialContext: got %v, want context.Canceled", err)
+	}
+}
+
+func TestHybridListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.sock")
+	tr := &HybridTransport{Path: path, CID: testGuestCID}
+
+	l, err := tr.Listen(CIDAny, 5000)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	if got, want := l.Addr(), (Addr{CIDHost, 5000}); got != want {
+		t.Errorf("Addr: got %#v, want %#v", got, want)
+	}
+
+	// The VMM forwards guest connections to "<Path>_<port>"
+	c, err := net.Dial("unix", path+"_5000")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer s.Close()
+
+	if got, want := s.LocalAddr().String(), (&Addr{CIDHost, 5000}).String(); got != want {
+		t.Errorf("LocalAddr: got %s, want %s", got, want)
+	}
+	if got, want := s.RemoteAddr().String(), (&Addr{testGuestCID, PortAny}).String(); got != want {
+		t.Errorf("RemoteAddr: got %s, want %s", got, want)
+	}
+
+	if _, err := tr.Listen(CIDAny, 5000); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Listen on a socket in use: got %v, want EADDRINUSE", err)
+	}
+	if _, err := tr.Listen(testGuestCID, 5001); !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		t.Errorf("Listen on guest CID: got %v, want EADDRNOTAVAIL", err)
+	}
+	if _, err := tr.Listen(CIDHost, PortAny); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Listen on PortAny: got %v, want EINVAL", err)
+	}
+}
+
+func TestHybridListenReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.sock")
+	staleSocket(t, path+"_5000")
+	tr := &HybridTransport{Path: path, CID: testGuestCID}
+
+	l, err := tr.Listen(CIDHost, 5000)
+	if err != nil {
+		t.Fatalf("Listen with a stale socket: %v", err)
+	}
+	defer l.Close()
+	c, err := net.Dial("unix", path+"_5000")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c.Close()
+}
+
+func TestHybridAcceptContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.sock")
+	tr := &HybridTransport{Path: path, CID: testGuestCID}
+	l, err := tr.Listen(CIDHost, 5000)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Close()
+		}
+		accepted <- err
+	}()
+
+	// The deadline borrowed by AcceptContext must not make the
+	// concurrent Accept fail.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.(Listener).AcceptContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AcceptContext: got %v, want context.DeadlineExceeded", err)
+	}
+	select {
+	case err := <-accepted:
+		t.Fatalf("Accept returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c, err := net.Dial("unix", path+"_5000")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if err := <-accepted; err != nil {
+		t.Errorf("Accept: %v", err)
+	}
+}
+
+func TestDefaultTransportDialContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.sock")
+	serveHybrid(t, path)
+	saved := DefaultTransport
+	DefaultTransport = &HybridTransport{Path: path, CID: testGuestCID}
+	defer func() { DefaultTransport = saved }()
+
+	c, err := DialContext(context.Background(), testGuestCID, 1234)
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer c.Close()
+	if got, want := c.LocalAddr().String(), (&Addr{CIDHost, testHostPort}).String(); got != want {
+		t.Errorf("LocalAddr: got %s, want %s", got, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := DialContext(ctx, testGuestCID, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext without reply: got %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,138 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package vsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// staleCheckTimeout is how long Listen waits when probing whether an
+// existing socket still has a listener
+const staleCheckTimeout = time.Second
+
+// HyperkitTransport provides access to virtio sockets of a HyperKit VM
+// from the host. HyperKit exposes them as Unix domain sockets in a
+// directory:
+//   - Connections to the VM are made by connecting to the "connect"
+//     socket and writing the destination as "%08x.%08x\n" (CID, port).
+//   - Connections from the VM to port P are forwarded to a socket
+//     named "%08x.%08x" (CID, P) on which the host listens.
+//
+// The zero value is not usable; Dir must be set.
+type HyperkitTransport struct {
+	// Dir is the directory containing the sockets.
+	Dir string
+}
+
+// Dial connects to the given port of the VM with the given CID
+func (t *HyperkitTransport) Dial(cid, port uint32) (Conn, error) {
+	return t.dialContext(context.Background(), nil, cid, port)
+}
+
+// DialContext connects to the given port of the VM with the given CID
+// using the provided context.
+func (t *HyperkitTransport) DialContext(ctx context.Context, cid, port uint32) (Conn, error) {
+	return t.dialContext(ctx, nil, cid, port)
+}
+
+func (t *HyperkitTransport) dialContext(ctx context.Context, control func(string, string, syscall.RawConn) error, cid, port uint32) (Conn, error) {
+	if t.Dir == "" {
+		return nil, fmt.Errorf("Dial(): hyperkit socket directory not set")
+	}
+	connectPath := filepath.Join(t.Dir, "connect")
+	if err := checkSocket(connectPath); err != nil {
+		return nil, fmt.Errorf("hyperkit: invalid connect socket: %w", err)
+	}
+
+	nd := net.Dialer{Control: control}
+	c, err := nd.DialContext(ctx, "unix", connectPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(c, "%08x.%08x\n", cid, port); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Failed to write dest (%08x.%08x) to %s: %w", cid, port, connectPath, err)
+	}
+	return c.(*net.UnixConn), nil
+}
+
+// Listen creates a listener for connections from the VM to the given
+// CID and port. An existing socket for the same address is replaced
+// if it is stale, i.e. nothing listens on it any more.
+func (t *HyperkitTransport) Listen(cid, port uint32) (net.Listener, error) {
+	var lc ListenConfig
+	return t.listenConfig(&lc, cid, port)
+}
+
+// listenConfig creates a listener for a specific vsock. Buffer sizes
+// are not supported by hyperkit.
+func (t *HyperkitTransport) listenConfig(lc *ListenConfig, cid, port uint32) (net.Listener, error) {
+	if lc.BufferSize != 0 || lc.BufferMinSize != 0 || lc.BufferMaxSize != 0 {
+		return nil, fmt.Errorf("Listen(): hyperkit does not support setting buffer sizes")
+	}
+	if port == 0 || port == PortAny {
+		return nil, fmt.Errorf("Listen(): hyperkit does not support binding to any port")
+	}
+	if t.Dir == "" {
+		return nil, fmt.Errorf("Listen(): hyperkit socket directory not set")
+	}
+
+	sock := filepath.Join(t.Dir, fmt.Sprintf("%08x.%08x", cid, port))
+	if err := removeStaleSocket(sock); err != nil {
+		return nil, fmt.Errorf("Listen(): %w", err)
+	}
+
+	nlc := net.ListenConfig{Control: lc.Control}
+	return nlc.Listen(context.Background(), "unix", sock)
+}
+
+// Name returns "hyperkit"
+func (t *HyperkitTransport) Name() string {
+	return "hyperkit"
+}
+
+// checkSocket returns an error if path is not a Unix domain socket
+func checkSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s: not a socket", path)
+	}
+	return nil
+}
+
+// removeStaleSocket removes the socket at path if nothing listens on
+// it any more. It fails if something still does, or if path is not a
+// socket.
+func removeStaleSocket(path string) error {
+	if err := checkSocket(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	c, err := net.DialTimeout("unix", path, staleCheckTimeout)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("%s: %w", path, syscall.EADDRINUSE)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -1,16 +1,19 @@
 // Package vsock provides bindings to the hyperkit based
 // implementation on macOS hosts.  virtio Sockets are exposed as named
 // pipes on macOS. Two modes are supported (to be set with
-// SockerMode()):
-// - Hyperkit mode: The package needs to be initialised with the path
-//   to where the named pipe was created.
-// - Docker for Mac mode: This is a shortcut which hard codes the
-//   location of the named pipe.
+// SocketMode()):
+//   - Hyperkit mode: The package needs to be initialised with the path
+//     to where the named pipe was created.
+//   - Docker for Mac mode: This is a shortcut which hard codes the
+//     location of the named pipe.
+//
+// See HyperkitTransport for using several VMs or other socket
+// directories.
 package vsock
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"path/filepath"
@@ -18,47 +21,80 @@ import (
 )
 
 var (
-	socketPath  string
-	connectPath string
-	socketFmt   string
+	// hyperkit is the transport configured by SocketMode()
+	hyperkit HyperkitTransport
+	// nativeTransport is the default value of DefaultTransport
+	nativeTransport = &hyperkit
 )
 
 // SocketMode initialises the bindings to either raw hyperkit mode
 // ("hyperkit:/path") or Docker for Mac mode ("docker"). This function
 // must be called before using the vsock bindings.
-func SocketMode(socketMode string) {
-	socketFmt = "%08x.%08x"
-
+func SocketMode(socketMode string) error {
 	if strings.HasPrefix(socketMode, "hyperkit:") {
-		socketPath = socketMode[len("hyperkit:"):]
+		hyperkit.Dir = socketMode[len("hyperkit:"):]
 	} else if socketMode == "docker" {
-		socketPath = filepath.Join(os.Getenv("HOME"), "/Library/Containers/com.docker.docker/Data/vms/0")
+		hyperkit.Dir = filepath.Join(os.Getenv("HOME"), "/Library/Containers/com.docker.docker/Data/vms/0")
 	} else {
-		log.Fatalln("Unknown socket mode: ", socketMode)
+		return fmt.Errorf("Unknown socket mode: %s", socketMode)
 	}
+	return nil
+}
 
-	connectPath = filepath.Join(socketPath, "connect")
+// dialContext creates a connection to the VM with the given client ID
+// and port via the hyperkit connect socket.
+func dialContext(ctx context.Context, d *Dialer, cid, port uint32) (Conn, error) {
+	return hyperkit.dialContext(ctx, d.Control, cid, port)
 }
 
-// Dial creates a connection to the VM with the given client ID and port
-func Dial(cid, port uint32) (Conn, error) {
-	c, err := net.DialUnix("unix", nil, &net.UnixAddr{connectPath, "unix"})
-	if err != nil {
-		return c, err
-	}
-	if _, err := fmt.Fprintf(c, "%08x.%08x\n", cid, port); err != nil {
-		return c, fmt.Errorf("Failed to write dest (%08x.%08x) to %s: %w", cid, port, connectPath, err)
-	}
-	return c, nil
+// listenConfig creates a listener for a specifc vsock. Buffer sizes
+// are not supported by hyperkit.
+func listenConfig(lc *ListenConfig, cid, port uint32) (net.Listener, error) {
+	return hyperkit.listenConfig(lc, cid, port)
+}
+
+// ListenPacket is not supported by hyperkit
+func ListenPacket(cid, port uint32) (PacketConn, error) {
+	return nil, fmt.Errorf("ListenPacket() not supported by hyperkit")
+}
+
+// DialPacket is not supported by hyperkit
+func DialPacket(cid, port uint32) (PacketConn, error) {
+	return nil, fmt.Errorf("DialPacket() not supported by hyperkit")
+}
+
+// DialSeqPacket is not supported by hyperkit
+func DialSeqPacket(cid, port uint32) (SeqPacketConn, error) {
+	return nil, fmt.Errorf("DialSeqPacket() not supported by hyperkit")
+}
+
+// ListenSeqPacket is not supported by hyperkit
+func ListenSeqPacket(cid, port uint32) (net.Listener, error) {
+	return nil, fmt.Errorf("ListenSeqPacket() not supported by hyperkit")
+}
+
+// ContextID returns CIDHost as hyperkit sockets are always on the host
+func ContextID() (uint32, error) {
+	return CIDHost, nil
 }
 
-// Listen creates a listener for a specifc vsock.
-func Listen(cid, port uint32) (net.Listener, error) {
-	sock := filepath.Join(socketPath, fmt.Sprintf(socketFmt, cid, port))
-	if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
-		log.Fatalln("Listen(): Remove:", err)
+// FileListener returns a listener for the hyperkit Unix domain socket
+// referenced by f.
+func FileListener(f *os.File) (net.Listener, error) {
+	return net.FileListener(f)
+}
+
+// FileConn returns a connection for the hyperkit Unix domain socket
+// referenced by f.
+func FileConn(f *os.File) (Conn, error) {
+	c, err := net.FileConn(f)
+	if err != nil {
 		return nil, err
 	}
-
-	return net.ListenUnix("unix", &net.UnixAddr{sock, "unix"})
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("%s: not a Unix domain socket", f.Name())
+	}
+	return uc, nil
 }
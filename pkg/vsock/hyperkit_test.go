@@ -0,0 +1,174 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package vsock
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// serveUnix listens on path and calls handle for every connection in
+// a new goroutine, until the test ends.
+func serveUnix(t *testing.T, path string, handle func(c net.Conn)) {
+	t.Helper()
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+}
+
+// staleSocket creates a socket at path which nothing listens on
+func staleSocket(t *testing.T, path string) {
+	t.Helper()
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("ListenUnix: %v", err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+}
+
+func TestHyperkitDial(t *testing.T) {
+	dir := t.TempDir()
+	// Stand-in for HyperKit: read the destination and echo it back,
+	// followed by the data sent on the connection.
+	serveUnix(t, filepath.Join(dir, "connect"), func(c net.Conn) {
+		r := bufio.NewReader(c)
+		dest, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(c, dest); err != nil {
+			return
+		}
+		io.Copy(c, r)
+	})
+
+	tr := &HyperkitTransport{Dir: dir}
+	c, err := tr.Dial(3, 0x1234)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := "00000003.00001234\nhello"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHyperkitDialErrors(t *testing.T) {
+	dir := t.TempDir()
+	tr := &HyperkitTransport{Dir: dir}
+	if _, err := tr.Dial(3, 1); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Dial without connect socket: got %v, want ErrNotExist", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "connect"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Dial(3, 1); err == nil {
+		t.Error("Dial with a regular file as connect socket succeeded")
+	}
+
+	if _, err := (&HyperkitTransport{}).Dial(3, 1); err == nil {
+		t.Error("Dial without Dir succeeded")
+	}
+}
+
+func TestHyperkitListen(t *testing.T) {
+	dir := t.TempDir()
+	tr := &HyperkitTransport{Dir: dir}
+	l, err := tr.Listen(CIDHost, 0x5678)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	// HyperKit connects to the socket named after the address
+	path := filepath.Join(dir, fmt.Sprintf("%08x.%08x", CIDHost, 0x5678))
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	s.Close()
+
+	if _, err := tr.Listen(CIDHost, 0x5678); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Listen on a socket in use: got %v, want EADDRINUSE", err)
+	}
+	if _, err := tr.Listen(CIDHost, PortAny); err == nil {
+		t.Error("Listen on PortAny succeeded")
+	}
+	if _, err := (&HyperkitTransport{}).Listen(CIDHost, 1); err == nil {
+		t.Error("Listen without Dir succeeded")
+	}
+}
+
+func TestHyperkitListenReplacesStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, fmt.Sprintf("%08x.%08x", CIDHost, 1))
+	staleSocket(t, path)
+
+	tr := &HyperkitTransport{Dir: dir}
+	l, err := tr.Listen(CIDHost, 1)
+	if err != nil {
+		t.Fatalf("Listen with a stale socket: %v", err)
+	}
+	defer l.Close()
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c.Close()
+}
+
+func TestHyperkitListenKeepsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, fmt.Sprintf("%08x.%08x", CIDHost, 1))
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &HyperkitTransport{Dir: dir}
+	if l, err := tr.Listen(CIDHost, 1); err == nil {
+		l.Close()
+		t.Fatal("Listen replaced a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("regular file was removed: %v", err)
+	}
+}
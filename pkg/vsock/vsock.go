@@ -8,13 +8,17 @@
 // golang.org/x/sys/unix.
 //
 // The package also provides bindings to the host interface to virtio
-// sockets for HyperKit on macOS.
+// sockets for HyperKit on macOS and, via HybridTransport, for
+// Firecracker and Cloud Hypervisor on Linux.
 package vsock
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"syscall"
+	"time"
 )
 
 const (
@@ -22,8 +26,14 @@ const (
 	CIDAny = 4294967295 // 2^32-1
 	// CIDHypervisor is the reserved CID for the Hypervisor
 	CIDHypervisor = 0
+	// CIDLocal is the CID for local (loopback) communication
+	CIDLocal = 1
 	// CIDHost is the reserved CID for the host system
 	CIDHost = 2
+
+	// PortAny is a wildcard port. Listening on it binds to a free
+	// port chosen by the kernel.
+	PortAny = 4294967295 // 2^32-1
 )
 
 // Addr represents the address of a vsock end point.
@@ -49,3 +59,185 @@ type Conn interface {
 	CloseWrite() error
 	File() (*os.File, error)
 }
+
+// SeqPacketConn is a vsock connection which preserves message
+// boundaries (SOCK_SEQPACKET). Like Conn it supports half-close.
+type SeqPacketConn interface {
+	Conn
+	// ReadMsg reads a single message into buf and returns the
+	// number of bytes read and the recvmsg(2) flags. If the
+	// message did not fit into buf the remainder is discarded and
+	// MSG_TRUNC is set in flags.
+	ReadMsg(buf []byte) (n, flags int, err error)
+	// WriteMsg sends buf as a single message.
+	WriteMsg(buf []byte) (int, error)
+}
+
+// PacketConn is a vsock datagram connection. Connections returned by
+// ListenPacket use ReadFrom and WriteTo, while connections returned by
+// DialPacket may also use Read and Write.
+type PacketConn interface {
+	net.Conn
+	net.PacketConn
+}
+
+// Listener is a vsock listener which, in addition to net.Listener,
+// supports accepting connections with a context. Listeners returned
+// by Listen on Linux implement this interface.
+type Listener interface {
+	net.Listener
+	AcceptContext(ctx context.Context) (net.Conn, error)
+}
+
+// Transport is a backend providing VM sockets, such as the kernel's
+// AF_VSOCK implementation or the Unix domain sockets of HyperKit.
+// Using several transports allows a single program to talk to VMs
+// hosted in different ways.
+type Transport interface {
+	// Dial connects to the port of the VM with the given CID
+	Dial(cid, port uint32) (Conn, error)
+	// Listen listens for connections on the given CID and port
+	Listen(cid, port uint32) (net.Listener, error)
+	// Name returns a short name for the transport, e.g. "kernel"
+	Name() string
+}
+
+// ContextDialer is implemented by transports which can abandon a
+// connection attempt when a context is done. All the transports of
+// this package implement it.
+type ContextDialer interface {
+	DialContext(ctx context.Context, cid, port uint32) (Conn, error)
+}
+
+// DefaultTransport is the transport used by the package level Dial,
+// DialContext and Listen functions. It is the kernel's AF_VSOCK implementation on
+// Linux and HyperKit (configured with SocketMode) on macOS.
+var DefaultTransport Transport = nativeTransport
+
+// Dialer contains options for connecting to a vsock address. It
+// mirrors net.Dialer. The zero value for each field is equivalent to
+// dialing without that option. Dialer always uses the platform's
+// native backend rather than DefaultTransport.
+type Dialer struct {
+	// Timeout is the maximum amount of time a dial will wait for
+	// a connect to complete. If Deadline is also set, it may fail
+	// earlier. On Linux the effective timeout is also passed to
+	// the kernel as SO_VM_SOCKETS_CONNECT_TIMEOUT, which otherwise
+	// defaults to 2 seconds.
+	Timeout time.Duration
+
+	// Deadline is the absolute point in time after which dials
+	// will fail.
+	Deadline time.Time
+
+	// Control, if not nil, is called after creating the socket
+	// but before connecting it. network is "vsock" and address is
+	// the string representation of the destination Addr.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// Dial connects to the CID.Port using the options in d.
+func (d *Dialer) Dial(cid, port uint32) (Conn, error) {
+	return d.DialContext(context.Background(), cid, port)
+}
+
+// DialContext connects to the CID.Port using the options in d and the
+// provided context. If the context expires before the connection is
+// complete, an error is returned. Once successfully connected, any
+// expiration of the context will not affect the connection.
+func (d *Dialer) DialContext(ctx context.Context, cid, port uint32) (Conn, error) {
+	deadline := d.Deadline
+	if d.Timeout != 0 {
+		t := time.Now().Add(d.Timeout)
+		if deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	return dialContext(ctx, d, cid, port)
+}
+
+// Dial connects to the CID.Port via DefaultTransport
+func Dial(cid, port uint32) (Conn, error) {
+	return DefaultTransport.Dial(cid, port)
+}
+
+// DialContext connects to the CID.Port via DefaultTransport using the
+// provided context. If DefaultTransport does not implement
+// ContextDialer, ctx is only checked before dialling.
+func DialContext(ctx context.Context, cid, port uint32) (Conn, error) {
+	if cd, ok := DefaultTransport.(ContextDialer); ok {
+		return cd.DialContext(ctx, cid, port)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: &Addr{cid, port}, Err: err}
+	}
+	return DefaultTransport.Dial(cid, port)
+}
+
+// Listen creates a listener for CID.Port via DefaultTransport
+func Listen(cid, port uint32) (net.Listener, error) {
+	return DefaultTransport.Listen(cid, port)
+}
+
+// ListenConfig contains options for listening on a vsock address. It
+// mirrors net.ListenConfig. The zero value for each field is
+// equivalent to listening without that option. Like Dialer, it uses
+// the platform's native backend.
+type ListenConfig struct {
+	// BufferSize, BufferMinSize and BufferMaxSize, if not zero,
+	// set the corresponding SO_VM_SOCKETS_BUFFER_* options on the
+	// listening socket. Accepted connections inherit them.
+	BufferSize    uint64
+	BufferMinSize uint64
+	BufferMaxSize uint64
+
+	// Control, if not nil, is called after creating the socket
+	// but before binding it. network is "vsock" and address is
+	// the string representation of the requested Addr.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// Listen returns a net.Listener which can accept connections on the
+// given port using the options in lc.
+func (lc *ListenConfig) Listen(cid, port uint32) (net.Listener, error) {
+	return listenConfig(lc, cid, port)
+}
+
+// VectorWriter is implemented by connections which can write several
+// buffers with a single writev(2) system call, e.g. to send a header
+// and a body together.
+//
+// net.Buffers.WriteTo only uses writev(2) for the standard library's
+// own connection types. Call Writev, or ReadFrom with a *net.Buffers,
+// on connections implementing VectorWriter instead.
+type VectorWriter interface {
+	Writev(bufs [][]byte) (int64, error)
+}
+
+// ZeroCopier is implemented by connections which can send large
+// writes with MSG_ZEROCOPY, avoiding the copy of the data into the
+// kernel. This saves CPU time for bulk transfers but adds overhead for
+// small writes, so it must be enabled explicitly.
+type ZeroCopier interface {
+	SetZeroCopy(enable bool) error
+}
+
+// BufferSizer is implemented by connections and listeners which allow
+// the size of the vsock buffer to be tuned. For listeners the settings
+// are inherited by accepted connections. The kernel clamps the buffer
+// size to the minimum and maximum sizes (256KiB by default).
+type BufferSizer interface {
+	BufferSize() (uint64, error)
+	// SetBufferSize sets the buffer size, raising the maximum
+	// buffer size first if needed.
+	SetBufferSize(size uint64) error
+	BufferMinSize() (uint64, error)
+	SetBufferMinSize(size uint64) error
+	BufferMaxSize() (uint64, error)
+	SetBufferMaxSize(size uint64) error
+}
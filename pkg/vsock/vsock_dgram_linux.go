@@ -0,0 +1,125 @@
+// Bindings to the Linux VM sockets datagram (SOCK_DGRAM) interface.
+
+package vsock
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenPacket returns a PacketConn bound to the given CID.Port which
+// can send and receive datagrams using ReadFrom and WriteTo. Note,
+// datagrams are only supported by some transports (e.g. virtio and
+// loopback on newer kernels). As with Listen, port 0 or PortAny
+// selects a free port.
+func ListenPacket(cid, port uint32) (PacketConn, error) {
+	if port == 0 {
+		port = PortAny
+	}
+	fd, err := syscall.Socket(unix.AF_VSOCK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create AF_VSOCK datagram socket: %w", err)
+	}
+
+	sa := &unix.SockaddrVM{CID: cid, Port: port}
+	if err = unix.Bind(fd, sa); err != nil {
+		_ = closeFD(fd)
+		return nil, fmt.Errorf("bind() to %08x.%08x failed: %w", cid, port, err)
+	}
+
+	local := boundAddr(fd, cid, port)
+	c, err := newVsockConn(fd, &local, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &vsockPacketConn{c}, nil
+}
+
+// DialPacket returns a PacketConn which sends datagrams to the given
+// CID.Port with Write and only receives datagrams from it.
+func DialPacket(cid, port uint32) (PacketConn, error) {
+	fd, err := syscall.Socket(unix.AF_VSOCK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create AF_VSOCK datagram socket: %w", err)
+	}
+
+	sa := &unix.SockaddrVM{CID: cid, Port: port}
+	if err = unix.Connect(fd, sa); err != nil {
+		_ = closeFD(fd)
+		return nil, fmt.Errorf("failed connect() to %08x.%08x: %w", cid, port, err)
+	}
+
+	c, err := newVsockConn(fd, localAddr(fd), &Addr{cid, port})
+	if err != nil {
+		return nil, err
+	}
+	return &vsockPacketConn{c}, nil
+}
+
+// vsockPacketConn is a datagram socket. Read, Write, Close and the
+// deadlines are provided by the embedded vsockConn.
+type vsockPacketConn struct {
+	*vsockConn
+}
+
+// ReadFrom reads a datagram and returns the number of bytes read and
+// the address of the sender.
+func (v *vsockPacketConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return 0, nil, v.opError("read", err)
+	}
+
+	var n int
+	var sa unix.Sockaddr
+	var rerr error
+	err = rc.Read(func(fd uintptr) bool {
+		n, sa, rerr = unix.Recvfrom(int(fd), buf, 0)
+		return rerr != unix.EAGAIN
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return 0, nil, v.opError("read", err)
+	}
+
+	if addr := sockaddrToVsock(sa); addr != nil {
+		return n, addr, nil
+	}
+	return n, nil, nil
+}
+
+// WriteTo sends a datagram to addr, which must be an Addr or *Addr.
+func (v *vsockPacketConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	var sa unix.SockaddrVM
+	switch a := addr.(type) {
+	case Addr:
+		sa = unix.SockaddrVM{CID: a.CID, Port: a.Port}
+	case *Addr:
+		sa = unix.SockaddrVM{CID: a.CID, Port: a.Port}
+	default:
+		return 0, v.opError("write", syscall.EINVAL)
+	}
+
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return 0, v.opError("write", err)
+	}
+
+	var werr error
+	err = rc.Write(func(fd uintptr) bool {
+		werr = unix.Sendto(int(fd), buf, 0, &sa)
+		return werr != unix.EAGAIN
+	})
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		return 0, v.opError("write", err)
+	}
+	return len(buf), nil
+}
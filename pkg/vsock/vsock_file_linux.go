@@ -0,0 +1,104 @@
+// Creating listeners and connections from existing VM sockets, e.g.
+// ones inherited via socket activation.
+
+package vsock
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileListener returns a listener for the listening vsock socket
+// referenced by f. The socket is duplicated, so it is the caller's
+// responsibility to close f when finished. Closing the listener does
+// not affect f, and closing f does not affect the listener.
+func FileListener(f *os.File) (net.Listener, error) {
+	fd, sotype, err := dupVsock(f)
+	if err != nil {
+		return nil, err
+	}
+	if sotype != syscall.SOCK_STREAM && sotype != syscall.SOCK_SEQPACKET {
+		_ = closeFD(fd)
+		return nil, fmt.Errorf("%s: unsupported socket type %d for a listener", f.Name(), sotype)
+	}
+	acceptConn, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+	if err != nil {
+		_ = closeFD(fd)
+		return nil, fmt.Errorf("%s: getsockopt(SO_ACCEPTCONN) failed: %w", f.Name(), err)
+	}
+	if acceptConn == 0 {
+		_ = closeFD(fd)
+		return nil, fmt.Errorf("%s: socket is not listening", f.Name())
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = closeFD(fd)
+		return nil, fmt.Errorf("failed to set fd %d non-blocking: %w", fd, err)
+	}
+
+	l, err := newVsockListener(fd, sotype, boundAddr(fd, CIDAny, PortAny))
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// FileConn returns a connection for the vsock socket referenced by
+// f. Depending on the socket type the connection also implements
+// SeqPacketConn or PacketConn. The socket is duplicated, so it is the
+// caller's responsibility to close f when finished. Closing the
+// connection does not affect f, and closing f does not affect the
+// connection.
+func FileConn(f *os.File) (Conn, error) {
+	fd, sotype, err := dupVsock(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var remote *Addr
+	if sa, err := unix.Getpeername(fd); err == nil {
+		remote = sockaddrToVsock(sa)
+	}
+	c, err := newVsockConn(fd, localAddr(fd), remote)
+	if err != nil {
+		return nil, err
+	}
+
+	switch sotype {
+	case syscall.SOCK_SEQPACKET:
+		return &vsockSeqPacketConn{c}, nil
+	case syscall.SOCK_DGRAM:
+		return &vsockPacketConn{c}, nil
+	}
+	return c, nil
+}
+
+// dupVsock duplicates the socket referenced by f, checks that it is
+// an AF_VSOCK socket and returns the new fd and the socket type.
+func dupVsock(f *os.File) (int, int, error) {
+	r0, _, e1 := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_DUPFD_CLOEXEC, 0)
+	if e1 != 0 {
+		return -1, 0, os.NewSyscallError("fcntl", e1)
+	}
+	fd := int(r0)
+
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		_ = closeFD(fd)
+		return -1, 0, fmt.Errorf("%s: getsockname() failed: %w", f.Name(), err)
+	}
+	if _, ok := sa.(*unix.SockaddrVM); !ok {
+		_ = closeFD(fd)
+		return -1, 0, fmt.Errorf("%s: not an AF_VSOCK socket", f.Name())
+	}
+
+	sotype, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		_ = closeFD(fd)
+		return -1, 0, fmt.Errorf("%s: getsockopt(SO_TYPE) failed: %w", f.Name(), err)
+	}
+	return fd, sotype, nil
+}
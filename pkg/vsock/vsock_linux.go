@@ -3,17 +3,27 @@
 package vsock
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
+const (
+	// IOCTL_VM_SOCKETS_GET_LOCAL_CID from <linux/vm_sockets.h>
+	ioctlVMSocketsGetLocalCID = 0x7b9
+)
+
 // SocketMode is a NOOP on Linux
-func SocketMode(m string) {
+func SocketMode(m string) error {
+	return nil
 }
 
 // Convert a generic unix.Sockaddr to a Addr
@@ -25,6 +35,54 @@ func sockaddrToVsock(sa unix.Sockaddr) *Addr {
 	return nil
 }
 
+// localAddr returns the local address of a socket using
+// getsockname(). If the socket is bound to CIDAny, the CID is
+// replaced with the result of ContextID(). It returns nil if the
+// address can't be determined.
+func localAddr(fd int) *Addr {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil
+	}
+	a := sockaddrToVsock(sa)
+	if a != nil && a.CID == CIDAny {
+		if cid, err := ContextID(); err == nil {
+			a.CID = cid
+		}
+	}
+	return a
+}
+
+// boundAddr returns the address a socket is bound to using
+// getsockname(). Unlike the requested address, this contains the port
+// chosen by the kernel when binding to PortAny. If getsockname()
+// fails the requested address is returned.
+func boundAddr(fd int, cid, port uint32) Addr {
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if a := sockaddrToVsock(sa); a != nil {
+			return *a
+		}
+	}
+	return Addr{cid, port}
+}
+
+// ContextID returns the local context ID (CID) of this system as
+// reported by the IOCTL_VM_SOCKETS_GET_LOCAL_CID ioctl on /dev/vsock.
+func ContextID() (uint32, error) {
+	f, err := os.Open("/dev/vsock")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var cid uint32
+	_, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioctlVMSocketsGetLocalCID, uintptr(unsafe.Pointer(&cid)))
+	if e1 != 0 {
+		return 0, os.NewSyscallError("ioctl", e1)
+	}
+	return cid, nil
+}
+
 // Closes fd, retrying EINTR
 func closeFD(fd int) error {
 	for {
@@ -39,65 +97,300 @@ func closeFD(fd int) error {
 	return nil
 }
 
-// Dial connects to the CID.Port via virtio sockets
-func Dial(cid, port uint32) (Conn, error) {
-	fd, err := syscall.Socket(unix.AF_VSOCK, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+// dialContext creates a non-blocking socket and connects it to
+// CID.Port. The socket is registered with the runtime poller before
+// connect() is called so that the wait for the connection to complete
+// can be interrupted by ctx.
+func dialContext(ctx context.Context, d *Dialer, cid, port uint32) (Conn, error) {
+	c, err := dial(ctx, d, syscall.SOCK_STREAM, cid, port)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial creates a socket of type sotype and connects it to CID.Port.
+func dial(ctx context.Context, d *Dialer, sotype int, cid, port uint32) (*vsockConn, error) {
+	remote := &Addr{cid, port}
+	if err := ctx.Err(); err != nil {
+		return nil, opError("dial", nil, remote, err)
+	}
+
+	fd, err := syscall.Socket(unix.AF_VSOCK, sotype|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, 0)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create AF_VSOCK socket: %w", err)
 	}
-	sa := &unix.SockaddrVM{CID: cid, Port: port}
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d", fd))
+	rc, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		// Make sure the kernel does not give up before we do.
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			file.Close()
+			return nil, opError("dial", nil, remote, context.DeadlineExceeded)
+		}
+		tv := unix.NsecToTimeval(timeout.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_CONNECT_TIMEOUT, &tv); err != nil {
+			file.Close()
+			return nil, opError("dial", nil, remote, os.NewSyscallError("setsockopt", err))
+		}
+	}
+
+	if d.Control != nil {
+		if err := d.Control("vsock", remote.String(), rc); err != nil {
+			file.Close()
+			return nil, opError("dial", nil, remote, err)
+		}
+	}
+
+	if err := connect(ctx, file, rc, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		file.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, opError("dial", nil, remote, err)
+	}
+	return &vsockConn{vsock: file, fd: uintptr(fd), local: localAddr(fd), remote: remote}, nil
+}
+
+// connect issues a non-blocking connect() on the socket wrapped by
+// file and waits for it to complete or for ctx to be done.
+func connect(ctx context.Context, file *os.File, rc syscall.RawConn, sa unix.Sockaddr) error {
+	var err error
 	// Retry connect in a loop if EINTR is encountered.
-	for {
-		if err := unix.Connect(fd, sa); err != nil {
-			if errno, ok := err.(syscall.Errno); ok && errno == syscall.EINTR {
-				continue
+	if cerr := rc.Control(func(fd uintptr) {
+		for {
+			err = unix.Connect(int(fd), sa)
+			if err != unix.EINTR {
+				break
 			}
-			// Trying not to leak fd here
-			_ = closeFD(fd)
-			return nil, fmt.Errorf("failed connect() to %08x.%08x: %w", cid, port, err)
 		}
-		break
+	}); cerr != nil {
+		return cerr
+	}
+	switch err {
+	case nil:
+		return nil
+	case unix.EINPROGRESS, unix.EALREADY:
+	default:
+		return os.NewSyscallError("connect", err)
+	}
+
+	stop := interruptOnDone(ctx, file.SetWriteDeadline)
+	defer stop()
+
+	werr := rc.Write(func(fd uintptr) bool {
+		var nerr int
+		nerr, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			err = os.NewSyscallError("getsockopt", err)
+			return true
+		}
+		switch errno := syscall.Errno(nerr); errno {
+		case unix.EINPROGRESS, unix.EALREADY, unix.EINTR:
+			return false
+		case unix.EISCONN:
+			err = nil
+			return true
+		case 0:
+			// The socket may be reported writable before the
+			// connection is complete. Check if we have a peer.
+			if _, perr := unix.Getpeername(int(fd)); perr != nil {
+				return false
+			}
+			err = nil
+			return true
+		default:
+			err = os.NewSyscallError("connect", errno)
+			return true
+		}
+	})
+	if werr != nil {
+		return werr
 	}
-	return newVsockConn(uintptr(fd), nil, &Addr{cid, port}), nil
+	return err
+}
+
+// KernelTransport is the Transport provided by the kernel's AF_VSOCK
+// implementation. It is the native transport on Linux.
+type KernelTransport struct{}
+
+// nativeTransport is the default value of DefaultTransport
+var nativeTransport = &KernelTransport{}
+
+// Dial connects to the CID.Port via the kernel
+func (t *KernelTransport) Dial(cid, port uint32) (Conn, error) {
+	var d Dialer
+	return d.Dial(cid, port)
 }
 
-// Listen returns a net.Listener which can accept connections on the given port
-func Listen(cid, port uint32) (net.Listener, error) {
-	fd, err := syscall.Socket(unix.AF_VSOCK, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+// DialContext connects to the CID.Port via the kernel using the
+// provided context, see Dialer.DialContext.
+func (t *KernelTransport) DialContext(ctx context.Context, cid, port uint32) (Conn, error) {
+	var d Dialer
+	return d.DialContext(ctx, cid, port)
+}
+
+// Listen returns a net.Listener which can accept connections on the
+// given port. If port is 0 or PortAny the kernel picks a free port,
+// which can be retrieved with Addr(). The returned listener also
+// implements Listener.
+func (t *KernelTransport) Listen(cid, port uint32) (net.Listener, error) {
+	var lc ListenConfig
+	return lc.Listen(cid, port)
+}
+
+// Name returns "kernel"
+func (t *KernelTransport) Name() string {
+	return "kernel"
+}
+
+// listenConfig creates a SOCK_STREAM listener configured by lc.
+func listenConfig(lc *ListenConfig, cid, port uint32) (net.Listener, error) {
+	l, err := listen(lc, syscall.SOCK_STREAM, cid, port)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// listen creates a listening socket of type sotype bound to
+// CID.Port. The options in lc are applied before the socket is bound.
+func listen(lc *ListenConfig, sotype int, cid, port uint32) (*vsockListener, error) {
+	if port == 0 {
+		port = PortAny
+	}
+	fd, err := syscall.Socket(unix.AF_VSOCK, sotype|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	l, err := newVsockListener(fd, sotype, Addr{cid, port})
 	if err != nil {
 		return nil, err
 	}
 
+	if err := l.configure(lc); err != nil {
+		l.file.Close()
+		return nil, opError("listen", nil, &l.local, err)
+	}
+
 	sa := &unix.SockaddrVM{CID: cid, Port: port}
 	if err = unix.Bind(fd, sa); err != nil {
+		l.file.Close()
 		return nil, fmt.Errorf("bind() to %08x.%08x failed: %w", cid, port, err)
 	}
 
 	err = syscall.Listen(fd, syscall.SOMAXCONN)
 	if err != nil {
+		l.file.Close()
 		return nil, fmt.Errorf("listen() on %08x.%08x failed: %w", cid, port, err)
 	}
-	return &vsockListener{fd, Addr{cid, port}}, nil
+	l.local = boundAddr(fd, cid, port)
+	return l, nil
 }
 
+// vsockListener wraps a non-blocking listening socket. The socket is
+// registered with the runtime poller via os.NewFile so that Close()
+// wakes up a blocked Accept().
 type vsockListener struct {
-	fd    int
-	local Addr
+	file   *os.File
+	rc     syscall.RawConn
+	sotype int
+	local  Addr
+	closed int32
+
+	deadline sharedDeadline // borrowed by AcceptContext
+}
+
+func newVsockListener(fd, sotype int, local Addr) (*vsockListener, error) {
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d", fd))
+	rc, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &vsockListener{file: file, rc: rc, sotype: sotype, local: local}, nil
 }
 
 // Accept accepts an incoming call and returns the new connection.
 func (v *vsockListener) Accept() (net.Conn, error) {
-	fd, sa, err := unix.Accept(v.fd)
+	return v.AcceptContext(context.Background())
+}
+
+// accept accepts an incoming call once
+func (v *vsockListener) accept() (net.Conn, error) {
+	var nfd int
+	var sa unix.Sockaddr
+	var aerr error
+	err := v.rc.Read(func(fd uintptr) bool {
+		for {
+			nfd, sa, aerr = unix.Accept4(int(fd), unix.SOCK_CLOEXEC)
+			if aerr != unix.EINTR && aerr != unix.ECONNABORTED {
+				break
+			}
+		}
+		return aerr != unix.EAGAIN
+	})
+	if err == nil {
+		err = aerr
+	}
+	if err != nil {
+		if atomic.LoadInt32(&v.closed) != 0 {
+			err = net.ErrClosed
+		}
+		return nil, opError("accept", nil, &v.local, err)
+	}
+	local := localAddr(nfd)
+	if local == nil {
+		local = &v.local
+	}
+	c, err := newVsockConn(nfd, local, sockaddrToVsock(sa))
 	if err != nil {
 		return nil, err
 	}
-	return newVsockConn(uintptr(fd), &v.local, sockaddrToVsock(sa)), nil
+	if v.sotype == syscall.SOCK_SEQPACKET {
+		return &vsockSeqPacketConn{c}, nil
+	}
+	return c, nil
+}
+
+// AcceptContext accepts an incoming call and returns the new
+// connection. If ctx is done before a connection arrives, the
+// context's error is returned.
+//
+// To interrupt the wait, AcceptContext borrows the deadline of the
+// listener, which also wakes up concurrent callers of Accept and
+// AcceptContext. These go back to waiting as long as their own context
+// is not done.
+func (v *vsockListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	for {
+		gen := v.deadline.generation()
+		stop := v.deadline.interruptOnDone(ctx, v.file.SetReadDeadline)
+		c, err := v.accept()
+		stop()
+
+		if err == nil {
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			return nil, opError("accept", nil, &v.local, ctx.Err())
+		}
+		if !v.deadline.retry(ctx, err, gen) {
+			return nil, err
+		}
+	}
 }
 
-// Close closes the listening connection
+// Close closes the listening connection and unblocks any pending
+// Accept calls, which return net.ErrClosed.
 func (v *vsockListener) Close() error {
-	// Note this won't cause the Accept to unblock.
-	return unix.Close(v.fd)
+	atomic.StoreInt32(&v.closed, 1)
+	return v.file.Close()
 }
 
 // Addr returns the address the Listener is listening on
@@ -105,26 +398,72 @@ func (v *vsockListener) Addr() net.Addr {
 	return v.local
 }
 
+// SyscallConn returns a raw network connection. It implements the
+// syscall.Conn interface.
+func (v *vsockListener) SyscallConn() (syscall.RawConn, error) {
+	return v.rc, nil
+}
+
 // a wrapper around FileConn which supports CloseRead and CloseWrite
 type vsockConn struct {
 	vsock  *os.File
 	fd     uintptr
 	local  *Addr
 	remote *Addr
+	zc     zeroCopy
 }
 
-func newVsockConn(fd uintptr, local, remote *Addr) *vsockConn {
-	vsock := os.NewFile(fd, fmt.Sprintf("vsock:%d", fd))
-	return &vsockConn{vsock: vsock, fd: fd, local: local, remote: remote}
+// newVsockConn wraps fd in a vsockConn. The fd is put into
+// non-blocking mode so that os.NewFile registers it with the runtime
+// poller, which provides deadline support. On error fd is closed.
+func newVsockConn(fd int, local, remote *Addr) (*vsockConn, error) {
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = closeFD(fd)
+		return nil, fmt.Errorf("failed to set fd %d non-blocking: %w", fd, err)
+	}
+	vsock := os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d", fd))
+	return &vsockConn{vsock: vsock, fd: uintptr(fd), local: local, remote: remote}, nil
+}
+
+// opError wraps an error returned by the underlying *os.File in a
+// *net.OpError, so that callers can use net.Error to check for
+// timeouts. io.EOF is passed through unchanged.
+func (v *vsockConn) opError(op string, err error) error {
+	return opError(op, v.local, v.remote, err)
+}
+
+func opError(op string, source, addr *Addr, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
+	oerr := &net.OpError{Op: op, Net: "vsock", Err: err}
+	// Avoid storing typed nil pointers in the net.Addr interfaces
+	if source != nil {
+		oerr.Source = source
+	}
+	if addr != nil {
+		oerr.Addr = addr
+	}
+	return oerr
 }
 
 // LocalAddr returns the local address of a connection
 func (v *vsockConn) LocalAddr() net.Addr {
+	if v.local == nil {
+		return nil
+	}
 	return v.local
 }
 
-// RemoteAddr returns the remote address of a connection
+// RemoteAddr returns the remote address of a connection. It returns
+// nil for unconnected datagram sockets.
 func (v *vsockConn) RemoteAddr() net.Addr {
+	if v.remote == nil {
+		return nil
+	}
 	return v.remote
 }
 
@@ -145,33 +484,48 @@ func (v *vsockConn) CloseWrite() error {
 
 // Read reads data from the connection
 func (v *vsockConn) Read(buf []byte) (int, error) {
-	return v.vsock.Read(buf)
+	n, err := v.vsock.Read(buf)
+	return n, v.opError("read", err)
 }
 
 // Write writes data over the connection
 func (v *vsockConn) Write(buf []byte) (int, error) {
-	return v.vsock.Write(buf)
+	if v.useZeroCopy(len(buf)) {
+		n, err := v.writeZeroCopy(buf)
+		return n, v.opError("write", err)
+	}
+	n, err := v.vsock.Write(buf)
+	return n, v.opError("write", err)
 }
 
 // SetDeadline sets the read and write deadlines associated with the connection
 func (v *vsockConn) SetDeadline(t time.Time) error {
-	return nil // FIXME
+	return v.opError("set", v.vsock.SetDeadline(t))
 }
 
 // SetReadDeadline sets the deadline for future Read calls.
 func (v *vsockConn) SetReadDeadline(t time.Time) error {
-	return nil // FIXME
+	return v.opError("set", v.vsock.SetReadDeadline(t))
 }
 
 // SetWriteDeadline sets the deadline for future Write calls
 func (v *vsockConn) SetWriteDeadline(t time.Time) error {
-	return nil // FIXME
+	return v.opError("set", v.vsock.SetWriteDeadline(t))
+}
+
+// SyscallConn returns a raw network connection. It implements the
+// syscall.Conn interface. The returned RawConn is integrated with the
+// runtime poller, so its Read and Write methods wait for the socket to
+// become ready and honour deadlines.
+func (v *vsockConn) SyscallConn() (syscall.RawConn, error) {
+	return v.vsock.SyscallConn()
 }
 
 // File duplicates the underlying socket descriptor and returns it.
 func (v *vsockConn) File() (*os.File, error) {
 	// This is equivalent to dup(2) but creates the new fd with CLOEXEC already set.
-	r0, _, e1 := syscall.Syscall(syscall.SYS_FCNTL, uintptr(v.vsock.Fd()), syscall.F_DUPFD_CLOEXEC, 0)
+	// Note: v.vsock.Fd() is not used as it would put the socket back into blocking mode.
+	r0, _, e1 := syscall.Syscall(syscall.SYS_FCNTL, v.fd, syscall.F_DUPFD_CLOEXEC, 0)
 	if e1 != 0 {
 		return nil, os.NewSyscallError("fcntl", e1)
 	}
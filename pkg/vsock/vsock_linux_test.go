@@ -0,0 +1,59 @@
+package vsock
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// tcpConnPair returns a vsockConn wrapping one end of a TCP loopback
+// connection and the other end. Like vsock sockets, TCP sockets
+// support splice(2) and MSG_ZEROCOPY, so the Linux specific code paths
+// of vsockConn can be tested without a VM.
+func tcpConnPair(t *testing.T) (*vsockConn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	peer, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	v := wrapConn(t, c.(syscall.Conn))
+	c.Close()
+	return v, peer
+}
+
+// wrapConn returns a vsockConn using a duplicate of the fd of c
+func wrapConn(t *testing.T, c syscall.Conn) *vsockConn {
+	t.Helper()
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	fd := -1
+	var derr error
+	if err := rc.Control(func(s uintptr) {
+		fd, derr = syscall.Dup(int(s))
+	}); err != nil {
+		t.Fatalf("Control: %v", err)
+	}
+	if derr != nil {
+		t.Fatalf("Dup: %v", derr)
+	}
+	syscall.CloseOnExec(fd)
+	v, err := newVsockConn(fd, &Addr{CIDLocal, 1}, &Addr{CIDLocal, 2})
+	if err != nil {
+		t.Fatalf("newVsockConn: %v", err)
+	}
+	t.Cleanup(func() { v.Close() })
+	return v
+}
@@ -0,0 +1,106 @@
+// Bindings to the Linux VM sockets SOCK_SEQPACKET interface.
+
+package vsock
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// DialSeqPacket connects to the CID.Port using a SOCK_SEQPACKET
+// socket. Note, SOCK_SEQPACKET is only supported by newer kernels.
+func DialSeqPacket(cid, port uint32) (SeqPacketConn, error) {
+	var d Dialer
+	c, err := dial(context.Background(), &d, syscall.SOCK_SEQPACKET, cid, port)
+	if err != nil {
+		return nil, err
+	}
+	return &vsockSeqPacketConn{c}, nil
+}
+
+// ListenSeqPacket returns a net.Listener which can accept SOCK_SEQPACKET
+// connections on the given port. The accepted connections implement
+// SeqPacketConn.
+func ListenSeqPacket(cid, port uint32) (net.Listener, error) {
+	var lc ListenConfig
+	l, err := listen(&lc, syscall.SOCK_SEQPACKET, cid, port)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// vsockSeqPacketConn is a message oriented connection. Read and Write
+// from the embedded vsockConn also operate on whole messages, but
+// silently truncate.
+type vsockSeqPacketConn struct {
+	*vsockConn
+}
+
+// ReadMsg reads a single message into buf. If the message was larger
+// than buf the remainder is discarded and MSG_TRUNC is set in flags.
+func (v *vsockSeqPacketConn) ReadMsg(buf []byte) (int, int, error) {
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return 0, 0, v.opError("read", err)
+	}
+
+	var n, flags int
+	var rerr error
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, flags, _, rerr = unix.Recvmsg(int(fd), buf, nil, 0)
+		return rerr != unix.EAGAIN
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return 0, 0, v.opError("read", err)
+	}
+	if n == 0 && len(buf) > 0 && flags&unix.MSG_TRUNC == 0 {
+		return 0, flags, io.EOF
+	}
+	return n, flags, nil
+}
+
+// WriteMsg sends buf as a single message.
+func (v *vsockSeqPacketConn) WriteMsg(buf []byte) (int, error) {
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return 0, v.opError("write", err)
+	}
+
+	var n int
+	var werr error
+	err = rc.Write(func(fd uintptr) bool {
+		n, werr = unix.SendmsgN(int(fd), buf, nil, nil, 0)
+		return werr != unix.EAGAIN
+	})
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		return n, v.opError("write", err)
+	}
+	if n != len(buf) {
+		return n, v.opError("write", io.ErrShortWrite)
+	}
+	return n, nil
+}
+
+// ReadFrom copies data from r, sending each chunk read as a message.
+// Unlike for stream connections splice(2) is not used, as it would
+// not preserve message boundaries.
+func (v *vsockSeqPacketConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{v}, r)
+}
+
+// WriteTo copies messages to w. Unlike for stream connections
+// splice(2) is not used, as it would not preserve message boundaries.
+func (v *vsockSeqPacketConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, readerOnly{v})
+}
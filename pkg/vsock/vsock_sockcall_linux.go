@@ -0,0 +1,23 @@
+//go:build linux && !386
+// +build linux,!386
+
+package vsock
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// getsockopt calls getsockopt(2) with a raw value pointer
+func getsockopt(fd uintptr, level, opt int, val unsafe.Pointer, vallen *uint32) syscall.Errno {
+	_, _, e1 := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(opt),
+		uintptr(val), uintptr(unsafe.Pointer(vallen)), 0)
+	return e1
+}
+
+// setsockopt calls setsockopt(2) with a raw value pointer
+func setsockopt(fd uintptr, level, opt int, val unsafe.Pointer, vallen uintptr) syscall.Errno {
+	_, _, e1 := syscall.Syscall6(syscall.SYS_SETSOCKOPT, fd, uintptr(level), uintptr(opt),
+		uintptr(val), vallen, 0)
+	return e1
+}
@@ -0,0 +1,27 @@
+package vsock
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// On 386 the socket system calls are multiplexed through
+// socketcall(2). From <linux/net.h>:
+const (
+	sysSetsockopt = 14
+	sysGetsockopt = 15
+)
+
+// getsockopt calls getsockopt(2) with a raw value pointer
+func getsockopt(fd uintptr, level, opt int, val unsafe.Pointer, vallen *uint32) syscall.Errno {
+	args := [6]uintptr{fd, uintptr(level), uintptr(opt), uintptr(val), uintptr(unsafe.Pointer(vallen))}
+	_, _, e1 := syscall.Syscall(syscall.SYS_SOCKETCALL, sysGetsockopt, uintptr(unsafe.Pointer(&args)), 0)
+	return e1
+}
+
+// setsockopt calls setsockopt(2) with a raw value pointer
+func setsockopt(fd uintptr, level, opt int, val unsafe.Pointer, vallen uintptr) syscall.Errno {
+	args := [6]uintptr{fd, uintptr(level), uintptr(opt), uintptr(val), vallen}
+	_, _, e1 := syscall.Syscall(syscall.SYS_SOCKETCALL, sysSetsockopt, uintptr(unsafe.Pointer(&args)), 0)
+	return e1
+}
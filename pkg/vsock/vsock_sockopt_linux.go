@@ -0,0 +1,167 @@
+// Socket options for Linux VM sockets.
+
+package vsock
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// getsockoptUint64 reads a 64bit AF_VSOCK level socket option.
+func getsockoptUint64(rc syscall.RawConn, opt int) (uint64, error) {
+	var val uint64
+	var e1 syscall.Errno
+	err := rc.Control(func(fd uintptr) {
+		l := uint32(unsafe.Sizeof(val))
+		e1 = getsockopt(fd, unix.AF_VSOCK, opt, unsafe.Pointer(&val), &l)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if e1 != 0 {
+		return 0, os.NewSyscallError("getsockopt", e1)
+	}
+	return val, nil
+}
+
+// setsockoptUint64 sets a 64bit AF_VSOCK level socket option.
+func setsockoptUint64(rc syscall.RawConn, opt int, val uint64) error {
+	var e1 syscall.Errno
+	err := rc.Control(func(fd uintptr) {
+		e1 = setsockopt(fd, unix.AF_VSOCK, opt, unsafe.Pointer(&val), unsafe.Sizeof(val))
+	})
+	if err != nil {
+		return err
+	}
+	if e1 != 0 {
+		return os.NewSyscallError("setsockopt", e1)
+	}
+	return nil
+}
+
+// setBufferSize sets SO_VM_SOCKETS_BUFFER_SIZE. The kernel silently
+// clamps the size to the maximum, so raise the maximum first if needed.
+func setBufferSize(rc syscall.RawConn, size uint64) error {
+	max, err := getsockoptUint64(rc, unix.SO_VM_SOCKETS_BUFFER_MAX_SIZE)
+	if err != nil {
+		return err
+	}
+	if size > max {
+		if err := setsockoptUint64(rc, unix.SO_VM_SOCKETS_BUFFER_MAX_SIZE, size); err != nil {
+			return err
+		}
+	}
+	return setsockoptUint64(rc, unix.SO_VM_SOCKETS_BUFFER_SIZE, size)
+}
+
+// configure applies the options in lc to the (not yet bound) listener.
+func (v *vsockListener) configure(lc *ListenConfig) error {
+	if lc.Control != nil {
+		if err := lc.Control("vsock", v.local.String(), v.rc); err != nil {
+			return err
+		}
+	}
+	if lc.BufferMaxSize != 0 {
+		if err := v.SetBufferMaxSize(lc.BufferMaxSize); err != nil {
+			return err
+		}
+	}
+	if lc.BufferMinSize != 0 {
+		if err := v.SetBufferMinSize(lc.BufferMinSize); err != nil {
+			return err
+		}
+	}
+	if lc.BufferSize != 0 {
+		if err := v.SetBufferSize(lc.BufferSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BufferSize returns the size of the buffer of the connection
+func (v *vsockConn) BufferSize() (uint64, error) {
+	return v.getsockopt("get", unix.SO_VM_SOCKETS_BUFFER_SIZE)
+}
+
+// SetBufferSize sets the size of the buffer of the connection
+func (v *vsockConn) SetBufferSize(size uint64) error {
+	rc, err := v.vsock.SyscallConn()
+	if err == nil {
+		err = setBufferSize(rc, size)
+	}
+	return v.opError("set", err)
+}
+
+// BufferMinSize returns the minimum buffer size of the connection
+func (v *vsockConn) BufferMinSize() (uint64, error) {
+	return v.getsockopt("get", unix.SO_VM_SOCKETS_BUFFER_MIN_SIZE)
+}
+
+// SetBufferMinSize sets the minimum buffer size of the connection
+func (v *vsockConn) SetBufferMinSize(size uint64) error {
+	return v.setsockopt("set", unix.SO_VM_SOCKETS_BUFFER_MIN_SIZE, size)
+}
+
+// BufferMaxSize returns the maximum buffer size of the connection
+func (v *vsockConn) BufferMaxSize() (uint64, error) {
+	return v.getsockopt("get", unix.SO_VM_SOCKETS_BUFFER_MAX_SIZE)
+}
+
+// SetBufferMaxSize sets the maximum buffer size of the connection
+func (v *vsockConn) SetBufferMaxSize(size uint64) error {
+	return v.setsockopt("set", unix.SO_VM_SOCKETS_BUFFER_MAX_SIZE, size)
+}
+
+func (v *vsockConn) getsockopt(op string, opt int) (uint64, error) {
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return 0, v.opError(op, err)
+	}
+	val, err := getsockoptUint64(rc, opt)
+	return val, v.opError(op, err)
+}
+
+func (v *vsockConn) setsockopt(op string, opt int, val uint64) error {
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return v.opError(op, err)
+	}
+	return v.opError(op, setsockoptUint64(rc, opt, val))
+}
+
+// BufferSize returns the buffer size inherited by accepted connections
+func (v *vsockListener) BufferSize() (uint64, error) {
+	val, err := getsockoptUint64(v.rc, unix.SO_VM_SOCKETS_BUFFER_SIZE)
+	return val, opError("get", nil, &v.local, err)
+}
+
+// SetBufferSize sets the buffer size inherited by accepted connections
+func (v *vsockListener) SetBufferSize(size uint64) error {
+	return opError("set", nil, &v.local, setBufferSize(v.rc, size))
+}
+
+// BufferMinSize returns the minimum buffer size inherited by accepted connections
+func (v *vsockListener) BufferMinSize() (uint64, error) {
+	val, err := getsockoptUint64(v.rc, unix.SO_VM_SOCKETS_BUFFER_MIN_SIZE)
+	return val, opError("get", nil, &v.local, err)
+}
+
+// SetBufferMinSize sets the minimum buffer size inherited by accepted connections
+func (v *vsockListener) SetBufferMinSize(size uint64) error {
+	return opError("set", nil, &v.local, setsockoptUint64(v.rc, unix.SO_VM_SOCKETS_BUFFER_MIN_SIZE, size))
+}
+
+// BufferMaxSize returns the maximum buffer size inherited by accepted connections
+func (v *vsockListener) BufferMaxSize() (uint64, error) {
+	val, err := getsockoptUint64(v.rc, unix.SO_VM_SOCKETS_BUFFER_MAX_SIZE)
+	return val, opError("get", nil, &v.local, err)
+}
+
+// SetBufferMaxSize sets the maximum buffer size inherited by accepted connections
+func (v *vsockListener) SetBufferMaxSize(size uint64) error {
+	return opError("set", nil, &v.local, setsockoptUint64(v.rc, unix.SO_VM_SOCKETS_BUFFER_MAX_SIZE, size))
+}
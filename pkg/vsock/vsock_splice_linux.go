@@ -0,0 +1,231 @@
+package vsock
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Moving data between a vsock connection and another socket or file
+// with io.Copy normally reads it into a user space buffer and writes
+// it out again. ReadFrom and WriteTo instead use splice(2) to move the
+// data through a pipe inside the kernel. See cmd/sock_stress/README.md
+// for how to measure the difference.
+
+const (
+	// maxSpliceSize is the maximum amount of data moved by one call
+	// to splice(2). The pipe is resized to match if possible.
+	maxSpliceSize = 1 << 20
+
+	// From <fcntl.h>
+	spliceFMove     = 0x1
+	spliceFNonblock = 0x2
+	fSetPipeSize    = 1031
+)
+
+// ReadFrom implements io.ReaderFrom. If r is a vsock, Unix stream or
+// TCP connection or a file the data is moved with splice(2). If r is a
+// *net.Buffers it is written with writev(2), see Writev. Otherwise it
+// is copied with io.Copy.
+func (v *vsockConn) ReadFrom(r io.Reader) (int64, error) {
+	if b, ok := r.(*net.Buffers); ok {
+		return v.writeBuffers(b)
+	}
+	remain := int64(1<<63 - 1)
+	lr, ok := r.(*io.LimitedReader)
+	if ok {
+		remain, r = lr.N, lr.R
+		if remain <= 0 {
+			return 0, nil
+		}
+	}
+
+	src, ok := spliceConn(r)
+	if !ok {
+		return genericReadFrom(v, r, lr)
+	}
+	n, handled, err := splice(v, src, remain)
+	if lr != nil {
+		lr.N -= n
+	}
+	if !handled {
+		m, err := genericReadFrom(v, r, lr)
+		return n + m, err
+	}
+	return n, v.opError("readfrom", err)
+}
+
+// WriteTo implements io.WriterTo. If w is a vsock, Unix stream or TCP
+// connection or a file the data is moved with splice(2), otherwise it
+// is copied with io.Copy.
+func (v *vsockConn) WriteTo(w io.Writer) (int64, error) {
+	dst, ok := spliceConn(w)
+	if !ok {
+		return io.Copy(w, readerOnly{v})
+	}
+	n, handled, err := splice(dst, v, int64(1<<63-1))
+	if !handled {
+		m, err := io.Copy(w, readerOnly{v})
+		return n + m, err
+	}
+	return n, v.opError("writeto", err)
+}
+
+// genericReadFrom copies from r with io.Copy. If lr is not nil, r is
+// the reader it wraps and the copy is limited accordingly.
+func genericReadFrom(v *vsockConn, r io.Reader, lr *io.LimitedReader) (int64, error) {
+	if lr != nil {
+		r = lr
+	}
+	return io.Copy(writerOnly{v}, r)
+}
+
+// readerOnly and writerOnly hide the io.WriterTo and io.ReaderFrom
+// methods of a connection so io.Copy does not call them recursively.
+type readerOnly struct {
+	io.Reader
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+// spliceable is a connection or file splice(2) may be used with
+type spliceable interface {
+	syscall.Conn
+	io.Writer
+}
+
+// spliceConn returns x as a spliceable if splice(2) can be used with
+// it. Datagram and seqpacket sockets are excluded as splicing would
+// not preserve message boundaries.
+func spliceConn(x interface{}) (spliceable, bool) {
+	switch c := x.(type) {
+	case *vsockConn:
+		return c, true
+	case *net.TCPConn:
+		return c, true
+	case *net.UnixConn:
+		if c.LocalAddr().Network() == "unix" {
+			return c, true
+		}
+	case *os.File:
+		return c, true
+	}
+	return nil, false
+}
+
+// splice moves up to remain bytes from src to dst through a pipe. If
+// handled is false splice(2) is not supported for src or dst and the
+// caller should copy the rest of the data, after the written bytes.
+func splice(dst, src spliceable, remain int64) (written int64, handled bool, err error) {
+	rsrc, err := src.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	rdst, err := dst.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	// Best effort, the default pipe size is 64KiB
+	_, _, _ = syscall.Syscall(syscall.SYS_FCNTL, uintptr(p[1]), fSetPipeSize, maxSpliceSize)
+
+	for remain > 0 {
+		max := maxSpliceSize
+		if remain < int64(max) {
+			max = int(remain)
+		}
+
+		// Move data from src into the pipe. The pipe is always
+		// empty here so EAGAIN means src has no data.
+		// syscall.Splice returns an int64 on 64-bit and an int on
+		// 32-bit platforms, so convert its result.
+		var n int
+		var serr error
+		err := rsrc.Read(func(fd uintptr) bool {
+			for {
+				sn, e := syscall.Splice(int(fd), nil, p[1], nil, max, spliceFMove|spliceFNonblock)
+				n, serr = int(sn), e
+				if serr != syscall.EINTR {
+					return serr != syscall.EAGAIN
+				}
+			}
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			if written == 0 && (err == syscall.EINVAL || err == syscall.ENOSYS) {
+				return 0, false, nil
+			}
+			return written, true, err
+		}
+		if n == 0 {
+			// EOF
+			return written, true, nil
+		}
+		remain -= int64(n)
+
+		// Drain the pipe into dst.
+		for n > 0 {
+			var m int
+			err := rdst.Write(func(fd uintptr) bool {
+				for {
+					sm, e := syscall.Splice(p[0], nil, int(fd), nil, n, spliceFMove|spliceFNonblock)
+					m, serr = int(sm), e
+					if serr != syscall.EINTR {
+						return serr != syscall.EAGAIN
+					}
+				}
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				if written == 0 && (err == syscall.EINVAL || err == syscall.ENOSYS) {
+					// dst does not support splice(2),
+					// e.g. a file opened with O_APPEND.
+					// Write out what is in the pipe.
+					m, err := drainPipe(dst, p[0], int64(n))
+					if err != nil {
+						return m, true, err
+					}
+					return m, false, nil
+				}
+				return written, true, err
+			}
+			n -= m
+			written += int64(m)
+		}
+	}
+	return written, true, nil
+}
+
+// drainPipe writes the n bytes in the pipe fd to w.
+func drainPipe(w io.Writer, fd int, n int64) (int64, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(fdReader(fd), buf); err != nil {
+		return 0, err
+	}
+	m, err := w.Write(buf)
+	return int64(m), err
+}
+
+// fdReader reads from a file descriptor
+type fdReader int
+
+func (fd fdReader) Read(b []byte) (int, error) {
+	n, err := syscall.Read(int(fd), b)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
@@ -0,0 +1,198 @@
+package vsock
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// unixConnPair returns the two ends of a Unix stream socket pair
+func unixConnPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("FileConn: %v", err)
+		}
+		conns[i] = c.(*net.UnixConn)
+		t.Cleanup(func() { c.Close() })
+	}
+	return conns[0], conns[1]
+}
+
+// send writes b to c in the background and then closes c
+func send(c net.Conn, b []byte) {
+	go func() {
+		c.Write(b)
+		c.Close()
+	}()
+}
+
+// receive reads everything from r in the background
+func receive(r io.Reader) <-chan []byte {
+	ch := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(r)
+		ch <- b
+	}()
+	return ch
+}
+
+func TestReadFrom(t *testing.T) {
+	want := pattern(3<<20 + 17)
+
+	for _, name := range []string{"tcp", "unix", "file"} {
+		v, peer := tcpConnPair(t)
+		received := receive(peer)
+
+		var src io.Reader
+		switch name {
+		case "tcp":
+			c, p := tcpConnPair(t)
+			send(p, want)
+			src = c
+		case "unix":
+			c, p := unixConnPair(t)
+			send(p, want)
+			src = c
+		case "file":
+			path := filepath.Join(t.TempDir(), "src")
+			if err := os.WriteFile(path, want, 0600); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			src = f
+		}
+		if _, ok := spliceConn(src); !ok {
+			t.Errorf("%s: splice(2) not used", name)
+		}
+
+		n, err := v.ReadFrom(src)
+		if err != nil || n != int64(len(want)) {
+			t.Errorf("%s: ReadFrom = %d, %v, want %d", name, n, err, len(want))
+		}
+		v.Close()
+		if got := <-received; !bytes.Equal(got, want) {
+			t.Errorf("%s: received %d bytes which differ from the %d sent", name, len(got), len(want))
+		}
+	}
+}
+
+func TestReadFromLimited(t *testing.T) {
+	data := pattern(3 << 20)
+
+	for _, limit := range []int64{0, 1, 4096, maxSpliceSize + 1, 2<<20 + 3} {
+		v, peer := tcpConnPair(t)
+		received := receive(peer)
+		c, p := tcpConnPair(t)
+		send(p, data)
+
+		lr := &io.LimitedReader{R: c, N: limit}
+		n, err := v.ReadFrom(lr)
+		if err != nil || n != limit {
+			t.Errorf("limit %d: ReadFrom = %d, %v", limit, n, err)
+		}
+		if lr.N != 0 {
+			t.Errorf("limit %d: LimitedReader.N = %d, want 0", limit, lr.N)
+		}
+		v.Close()
+		if got := <-received; !bytes.Equal(got, data[:limit]) {
+			t.Errorf("limit %d: received %d bytes which differ from the data sent", limit, len(got))
+		}
+		// Nothing beyond the limit was consumed
+		if rest, err := io.ReadAll(c); err != nil || !bytes.Equal(rest, data[limit:]) {
+			t.Errorf("limit %d: %d bytes left to read, want %d (%v)", limit, len(rest), len(data)-int(limit), err)
+		}
+	}
+}
+
+func TestReadFromGeneric(t *testing.T) {
+	data := pattern(100000)
+
+	v, peer := tcpConnPair(t)
+	received := receive(peer)
+	lr := &io.LimitedReader{R: bytes.NewReader(data), N: 1000}
+	n, err := v.ReadFrom(lr)
+	if err != nil || n != 1000 || lr.N != 0 {
+		t.Errorf("ReadFrom = %d, %v with %d bytes left, want 1000", n, err, lr.N)
+	}
+	b := net.Buffers{data[1000:5000], nil, data[5000:]}
+	n, err = v.ReadFrom(&b)
+	if err != nil || n != int64(len(data)-1000) || len(b) != 0 {
+		t.Errorf("ReadFrom(net.Buffers) = %d, %v with %d buffers left", n, err, len(b))
+	}
+	v.Close()
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes which differ from the %d sent", len(got), len(data))
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	want := pattern(3<<20 + 17)
+
+	for _, name := range []string{"tcp", "unix"} {
+		v, peer := tcpConnPair(t)
+		send(peer, want)
+
+		var dst net.Conn
+		var received <-chan []byte
+		switch name {
+		case "tcp":
+			c, p := tcpConnPair(t)
+			dst, received = c, receive(p)
+		case "unix":
+			c, p := unixConnPair(t)
+			dst, received = c, receive(p)
+		}
+
+		n, err := v.WriteTo(dst)
+		if err != nil || n != int64(len(want)) {
+			t.Errorf("%s: WriteTo = %d, %v, want %d", name, n, err, len(want))
+		}
+		dst.Close()
+		if got := <-received; !bytes.Equal(got, want) {
+			t.Errorf("%s: received %d bytes which differ from the %d sent", name, len(got), len(want))
+		}
+	}
+}
+
+func TestWriteToFile(t *testing.T) {
+	want := pattern(3<<20 + 17)
+
+	for _, flag := range []int{0, os.O_APPEND} {
+		v, peer := tcpConnPair(t)
+		send(peer, want)
+
+		// splice(2) to a file opened with O_APPEND fails with
+		// EINVAL after the data has been moved into the pipe, so
+		// this tests the drainPipe fallback.
+		path := filepath.Join(t.TempDir(), "dst")
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := v.WriteTo(f)
+		if err != nil || n != int64(len(want)) {
+			t.Errorf("flag %#x: WriteTo = %d, %v, want %d", flag, n, err, len(want))
+		}
+		f.Close()
+		if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("flag %#x: file has %d bytes which differ from the %d sent (%v)", flag, len(got), len(want), err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package vsock
+
+import (
+	"net"
+
+	"github.com/linuxkit/virtsock/internal/writev"
+)
+
+// Writev writes the buffers in bufs to the connection using writev(2).
+// Small buffers, such as a header and a body, are sent with a single
+// system call. It returns the number of bytes written. bufs is not
+// modified.
+func (v *vsockConn) Writev(bufs [][]byte) (int64, error) {
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return 0, v.opError("writev", err)
+	}
+	n, err := writev.Write(rc, bufs, 0)
+	return n, v.opError("writev", err)
+}
+
+// writeBuffers writes the buffers in b with writev(2) and consumes
+// what was written, like net.Buffers.WriteTo does for the standard
+// library's connections.
+func (v *vsockConn) writeBuffers(b *net.Buffers) (int64, error) {
+	n, err := v.Writev(*b)
+	*b = writev.Consume(*b, n)
+	return n, err
+}
@@ -0,0 +1,218 @@
+package vsock
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Zero-copy transmission, see Documentation/networking/msg_zerocopy.rst
+// in the kernel tree. With MSG_ZEROCOPY the kernel sends data straight
+// from the pages of the user buffer instead of copying it. Once it is
+// done with the pages it queues a completion notification on the
+// socket's error queue. Write only returns once all notifications for
+// its buffer have been received, so the caller may reuse the buffer as
+// usual, unless the write deadline expires first.
+
+const (
+	// From <asm-generic/socket.h> and <linux/socket.h>
+	soZeroCopy  = 60
+	msgZeroCopy = 0x4000000
+
+	// From <linux/errqueue.h>
+	soEEOriginZeroCopy   = 5
+	soEECodeZeroCopyCopy = 1
+
+	// zeroCopyMinSize is the smallest write sent with MSG_ZEROCOPY.
+	// For smaller writes page pinning and notifications cost more
+	// than the copy.
+	zeroCopyMinSize = 64 * 1024
+)
+
+// sockExtendedErr is struct sock_extended_err from <linux/errqueue.h>
+type sockExtendedErr struct {
+	Errno  uint32
+	Origin uint8
+	Type   uint8
+	Code   uint8
+	Pad    uint8
+	Info   uint32
+	Data   uint32
+}
+
+// zeroCopy is the zero-copy state of a connection
+type zeroCopy struct {
+	enabled int32 // accessed atomically
+	// mu serialises zero-copy writes so notifications can be
+	// attributed to them
+	mu sync.Mutex
+	// pending is the number of send calls whose notifications
+	// have not been received yet, because the write deadline
+	// expired. buf keeps the buffer they send from alive.
+	pending uint32
+	buf     []byte
+}
+
+// SetZeroCopy enables or disables sending writes of 64KiB or more with
+// MSG_ZEROCOPY. It returns an error if the kernel or the vsock
+// transport do not support it, in which case writes continue to copy
+// the data. Zero-copy is disabled again automatically if the kernel
+// reports that it had to copy the data anyway.
+//
+// A zero-copy Write only returns once the kernel is done with the
+// buffer or the write deadline expires. In the latter case the kernel
+// may still send from the buffer after Write returned the timeout, so
+// its contents should not be changed; the next zero-copy Write first
+// waits for the kernel to release it.
+func (v *vsockConn) SetZeroCopy(enable bool) error {
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return v.opError("set", err)
+	}
+	val := 0
+	if enable {
+		val = 1
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soZeroCopy, val)
+	})
+	if err == nil && serr != nil {
+		err = os.NewSyscallError("setsockopt", serr)
+	}
+	if err != nil {
+		return v.opError("set", err)
+	}
+	atomic.StoreInt32(&v.zc.enabled, int32(val))
+	return nil
+}
+
+// useZeroCopy returns true if a write of n bytes should use MSG_ZEROCOPY
+func (v *vsockConn) useZeroCopy(n int) bool {
+	return n >= zeroCopyMinSize && atomic.LoadInt32(&v.zc.enabled) != 0
+}
+
+// writeZeroCopy writes buf with MSG_ZEROCOPY and waits until the
+// kernel no longer uses it.
+func (v *vsockConn) writeZeroCopy(buf []byte) (int, error) {
+	v.zc.mu.Lock()
+	defer v.zc.mu.Unlock()
+
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	// Wait for a write which timed out first
+	if err := v.reapZeroCopy(rc); err != nil {
+		return 0, err
+	}
+
+	v.zc.buf = buf
+	written := 0
+	for written < len(buf) {
+		var n int
+		var serr error
+		err = rc.Write(func(fd uintptr) bool {
+			for {
+				n, serr = syscall.SendmsgN(int(fd), buf[written:], nil, nil, msgZeroCopy)
+				if serr != syscall.EINTR {
+					return serr != syscall.EAGAIN
+				}
+			}
+		})
+		if err == nil && serr != nil {
+			err = os.NewSyscallError("sendmsg", serr)
+		}
+		if err != nil {
+			break
+		}
+		written += n
+		v.zc.pending++
+	}
+
+	// Even on error, buf may only be released once the kernel has
+	// released all the pages sent so far.
+	rerr := v.reapZeroCopy(rc)
+
+	if serr, ok := err.(*os.SyscallError); ok && serr.Err == syscall.ENOBUFS && rerr == nil {
+		// Too many pages pinned (net.core.optmem_max), copy
+		// the rest instead.
+		n, err := v.vsock.Write(buf[written:])
+		return written + n, err
+	}
+	if err == nil {
+		err = rerr
+	}
+	return written, err
+}
+
+// reapZeroCopy waits for the notifications of the pending send calls
+// of the connection and releases their buffer. It must be called with
+// v.zc.mu held. If the write deadline expires first, the remaining
+// calls stay pending.
+func (v *vsockConn) reapZeroCopy(rc syscall.RawConn) error {
+	done, copied, err := reapZeroCopy(rc, v.zc.pending)
+	v.zc.pending -= done
+	if v.zc.pending == 0 {
+		v.zc.buf = nil
+	}
+	if copied {
+		atomic.StoreInt32(&v.zc.enabled, 0)
+	}
+	return err
+}
+
+// reapZeroCopy reads completion notifications from the error queue
+// until n send calls are complete or an error, such as the write
+// deadline expiring, occurs. It returns the number of send calls
+// completed. copied is true if the kernel reported that it copied the
+// data anyway.
+func reapZeroCopy(rc syscall.RawConn, n uint32) (done uint32, copied bool, err error) {
+	oob := make([]byte, syscall.CmsgSpace(int(unsafe.Sizeof(sockExtendedErr{}))))
+	for done < n {
+		var oobn int
+		var serr error
+		// Wait with Write, not Read: a pending Read on the
+		// connection holds the read lock. A notification sets
+		// POLLERR, which wakes up writers too.
+		err = rc.Write(func(fd uintptr) bool {
+			for {
+				_, oobn, _, _, serr = syscall.Recvmsg(int(fd), nil, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+				if serr != syscall.EINTR {
+					return serr != syscall.EAGAIN
+				}
+			}
+		})
+		if err == nil && serr != nil {
+			err = os.NewSyscallError("recvmsg", serr)
+		}
+		if err != nil {
+			return done, copied, err
+		}
+
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return done, copied, err
+		}
+		for _, m := range msgs {
+			if len(m.Data) < int(unsafe.Sizeof(sockExtendedErr{})) {
+				continue
+			}
+			ee := (*sockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+			if ee.Origin != soEEOriginZeroCopy {
+				continue
+			}
+			if ee.Errno != 0 {
+				return done, copied, os.NewSyscallError("recvmsg", syscall.Errno(ee.Errno))
+			}
+			// Notifications cover the send calls Info to Data
+			done += ee.Data - ee.Info + 1
+			if ee.Code&soEECodeZeroCopyCopy != 0 {
+				copied = true
+			}
+		}
+	}
+	return done, copied, nil
+}
@@ -0,0 +1,96 @@
+package vsock
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// pattern returns n bytes of test data
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestZeroCopyWrite(t *testing.T) {
+	v, peer := tcpConnPair(t)
+	if err := v.SetZeroCopy(true); err != nil {
+		t.Skipf("SetZeroCopy: %v", err)
+	}
+
+	received := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(peer)
+		received <- b
+	}()
+
+	buf := pattern(4 << 20)
+	n, err := v.Write(buf)
+	if err != nil || n != len(buf) {
+		t.Fatalf("Write: %d, %v", n, err)
+	}
+	// The buffer is ours again once Write returns
+	for i := range buf {
+		buf[i] = 0
+	}
+	v.Close()
+	if got := <-received; !bytes.Equal(got, pattern(len(buf))) {
+		t.Errorf("received %d bytes which differ from the data written", len(got))
+	}
+}
+
+func TestZeroCopyWriteDeadline(t *testing.T) {
+	v, peer := tcpConnPair(t)
+	if err := v.SetZeroCopy(true); err != nil {
+		t.Skipf("SetZeroCopy: %v", err)
+	}
+
+	// Nobody reads, so neither the send calls nor their
+	// notifications complete before the deadline.
+	first := pattern(32 << 20)
+	if err := v.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("SetWriteDeadline: %v", err)
+	}
+	start := time.Now()
+	n, err := v.Write(first)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write: got %d, %v, want os.ErrDeadlineExceeded", n, err)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Write: %v is not a timeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Write returned %v after the deadline", d)
+	}
+
+	received := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(peer)
+		received <- b
+	}()
+
+	// The next write waits for the earlier one to be released
+	if err := v.SetWriteDeadline(time.Time{}); err != nil {
+		t.Fatalf("SetWriteDeadline: %v", err)
+	}
+	second := pattern(1 << 20)
+	if m, err := v.Write(second); err != nil || m != len(second) {
+		t.Fatalf("Write after the deadline was cleared: %d, %v", m, err)
+	}
+	if v.zc.pending != 0 || v.zc.buf != nil {
+		t.Errorf("%d send calls still pending", v.zc.pending)
+	}
+	v.Close()
+
+	want := append(first[:n:n], second...)
+	if got := <-received; !bytes.Equal(got, want) {
+		t.Errorf("received %d bytes, want the %d bytes written", len(got), len(want))
+	}
+}
@@ -0,0 +1,374 @@
+package vsocktest
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// bufferSize is the amount of data buffered in each direction of a
+// connection before writes block
+const bufferSize = 64 * 1024
+
+// pipe is one direction of a connection
+type pipe struct {
+	mu      sync.Mutex
+	buf     []byte
+	wclosed bool  // no more data will be written
+	rclosed bool  // no more data will be read
+	err     error // set when the connection is reset
+	// changed is closed and replaced whenever the state changes
+	changed chan struct{}
+}
+
+func newPipe() *pipe {
+	return &pipe{changed: make(chan struct{})}
+}
+
+// notify wakes up all waiters. It must be called with p.mu held.
+func (p *pipe) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *pipe) closeRead() {
+	p.mu.Lock()
+	p.rclosed = true
+	p.buf = nil
+	p.notify()
+	p.mu.Unlock()
+}
+
+func (p *pipe) closeWrite() {
+	p.mu.Lock()
+	p.wclosed = true
+	p.notify()
+	p.mu.Unlock()
+}
+
+func (p *pipe) reset() {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = syscall.ECONNRESET
+		p.buf = nil
+		p.notify()
+	}
+	p.mu.Unlock()
+}
+
+// conn is a vsock.Conn between two Endpoints
+type conn struct {
+	e             *Endpoint
+	local, remote *vsock.Addr
+	rx, tx        *pipe
+
+	readDeadline, writeDeadline *deadline
+
+	once sync.Once
+	done chan struct{}
+}
+
+// newConnPair returns both ends of a connection between local and
+// remote
+func newConnPair(local, remote *vsock.Addr) (*conn, *conn) {
+	a, b := newPipe(), newPipe()
+	c := &conn{
+		local:         local,
+		remote:        remote,
+		rx:            a,
+		tx:            b,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		done:          make(chan struct{}),
+	}
+	peer := &conn{
+		local:         remote,
+		remote:        local,
+		rx:            b,
+		tx:            a,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		done:          make(chan struct{}),
+	}
+	return c, peer
+}
+
+func (c *conn) opError(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return opError(op, c.local, c.remote, err)
+}
+
+func (c *conn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// LocalAddr returns the local address of the connection
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the remote address of the connection
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Read reads data from the connection
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.read(b)
+	return n, c.opError("read", err)
+}
+
+func (c *conn) read(b []byte) (int, error) {
+	p := c.rx
+	for {
+		if c.isClosed() {
+			return 0, net.ErrClosed
+		}
+		deadline := c.readDeadline.wait()
+		select {
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		default:
+		}
+
+		p.mu.Lock()
+		if p.err != nil {
+			p.mu.Unlock()
+			return 0, p.err
+		}
+		if len(p.buf) > 0 {
+			n := copy(b, p.buf)
+			p.buf = p.buf[n:]
+			p.notify()
+			p.mu.Unlock()
+			return n, nil
+		}
+		if p.wclosed || p.rclosed {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		if len(b) == 0 {
+			return 0, nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+// Write writes data to the connection. It blocks while the peer has
+// bufferSize bytes of unread data.
+func (c *conn) Write(b []byte) (int, error) {
+	n, err := c.write(b)
+	return n, c.opError("write", err)
+}
+
+func (c *conn) write(b []byte) (int, error) {
+	p := c.tx
+	written := 0
+	for {
+		if c.isClosed() {
+			return written, net.ErrClosed
+		}
+		deadline := c.writeDeadline.wait()
+		select {
+		case <-deadline:
+			return written, os.ErrDeadlineExceeded
+		default:
+		}
+
+		p.mu.Lock()
+		if p.err != nil {
+			p.mu.Unlock()
+			return written, p.err
+		}
+		if p.wclosed || p.rclosed {
+			p.mu.Unlock()
+			return written, syscall.EPIPE
+		}
+		if space := bufferSize - len(p.buf); space > 0 {
+			n := len(b) - written
+			if n > space {
+				n = space
+			}
+			p.buf = append(p.buf, b[written:written+n]...)
+			written += n
+			p.notify()
+		}
+		if written == len(b) {
+			p.mu.Unlock()
+			return written, nil
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return written, os.ErrDeadlineExceeded
+		case <-c.done:
+			return written, net.ErrClosed
+		}
+	}
+}
+
+// Close closes the connection. The peer reads any buffered data and
+// then EOF; its writes fail with EPIPE.
+func (c *conn) Close() error {
+	if c.isClosed() {
+		return c.opError("close", net.ErrClosed)
+	}
+	c.once.Do(func() {
+		close(c.done)
+		c.rx.closeRead()
+		c.tx.closeWrite()
+		c.readDeadline.close()
+		c.writeDeadline.close()
+		if c.e != nil {
+			c.e.forget(c)
+		}
+	})
+	return nil
+}
+
+// CloseRead shuts down the reading side of the connection
+func (c *conn) CloseRead() error {
+	if c.isClosed() {
+		return c.opError("close", net.ErrClosed)
+	}
+	c.rx.closeRead()
+	return nil
+}
+
+// CloseWrite shuts down the writing side of the connection
+func (c *conn) CloseWrite() error {
+	if c.isClosed() {
+		return c.opError("close", net.ErrClosed)
+	}
+	c.tx.closeWrite()
+	return nil
+}
+
+// reset aborts the connection in both directions
+func (c *conn) reset() {
+	c.rx.reset()
+	c.tx.reset()
+}
+
+// File is not supported as there is no file descriptor
+func (c *conn) File() (*os.File, error) {
+	return nil, c.opError("file", syscall.EOPNOTSUPP)
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *conn) SetDeadline(t time.Time) error {
+	if c.isClosed() {
+		return c.opError("set", net.ErrClosed)
+	}
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline
+func (c *conn) SetReadDeadline(t time.Time) error {
+	if c.isClosed() {
+		return c.opError("set", net.ErrClosed)
+	}
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	if c.isClosed() {
+		return c.opError("set", net.ErrClosed)
+	}
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is a channel which is closed when the deadline expires
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	expiry chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{expiry: make(chan struct{})}
+}
+
+// set sets the deadline. The zero time clears it.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expiry // Wait for the timer to fire
+	}
+	d.timer = nil
+
+	expired := isDone(d.expiry)
+	if t.IsZero() {
+		if expired {
+			d.expiry = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.expiry = make(chan struct{})
+		}
+		expiry := d.expiry
+		d.timer = time.AfterFunc(dur, func() { close(expiry) })
+		return
+	}
+	if !expired {
+		close(d.expiry)
+	}
+}
+
+// wait returns a channel which is closed when the deadline expires
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expiry
+}
+
+// close stops the timer, if any
+func (d *deadline) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+func isDone(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,71 @@
+package vsocktest
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// listener is a vsock.Listener bound on an Endpoint
+type listener struct {
+	e     *Endpoint
+	addr  vsock.Addr
+	queue chan *conn
+
+	once sync.Once
+	done chan struct{}
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *listener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext is like Accept but gives up when ctx is done.
+func (l *listener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case c := <-l.queue:
+		return c, nil
+	case <-l.done:
+		return nil, opError("accept", nil, &l.addr, net.ErrClosed)
+	case <-ctx.Done():
+		return nil, opError("accept", nil, &l.addr, ctx.Err())
+	}
+}
+
+// Close stops listening. Connections which have not been accepted yet
+// are reset.
+func (l *listener) Close() error {
+	h := l.e.h
+	h.mu.Lock()
+	if h.listeners[l.addr] == l {
+		delete(h.listeners, l.addr)
+	}
+	h.mu.Unlock()
+	l.shutdown()
+	return nil
+}
+
+// shutdown wakes up Accept and resets any queued connections. The
+// listener must have been removed from the hypervisor already so no
+// more connections are queued.
+func (l *listener) shutdown() {
+	l.once.Do(func() { close(l.done) })
+	for {
+		select {
+		case c := <-l.queue:
+			l.e.forget(c)
+			c.reset()
+		default:
+			return
+		}
+	}
+}
+
+// Addr returns the address the listener is bound to. Like the
+// listeners of the vsock package it is a vsock.Addr value.
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,255 @@
+// Package vsocktest provides an in-memory implementation of VM sockets
+// for testing code built on the vsock package without a VM or the
+// vsock_loopback kernel module.
+//
+// A Hypervisor hands out CIDs to Endpoints. Each Endpoint can Dial and
+// Listen much like the functions of the vsock package, and connections
+// between Endpoints behave like vsock stream sockets: they support
+// half-close and deadlines, dialling a port nobody listens on fails
+// with ECONNREFUSED, and connections are reset with ECONNRESET when an
+// Endpoint is closed.
+package vsocktest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+const (
+	// firstCID is the first CID handed out to a VM
+	firstCID = 3
+	// firstEphemeralPort is the first port used for ephemeral binds
+	firstEphemeralPort = 49152
+	// backlog is the number of connections queued on a listener
+	// before further connection attempts are refused
+	backlog = 16
+)
+
+// Hypervisor connects a set of Endpoints. The zero value is not
+// usable, create one with NewHypervisor.
+type Hypervisor struct {
+	mu        sync.Mutex
+	nextCID   uint32
+	nextPort  uint32
+	endpoints map[uint32]*Endpoint
+	listeners map[vsock.Addr]*listener
+}
+
+// NewHypervisor creates an empty hypervisor. The host endpoint is
+// created on demand by Host().
+func NewHypervisor() *Hypervisor {
+	return &Hypervisor{
+		nextCID:   firstCID,
+		nextPort:  firstEphemeralPort,
+		endpoints: make(map[uint32]*Endpoint),
+		listeners: make(map[vsock.Addr]*listener),
+	}
+}
+
+// Host returns the endpoint of the host, which has CID vsock.CIDHost.
+func (h *Hypervisor) Host() *Endpoint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e, ok := h.endpoints[vsock.CIDHost]; ok {
+		return e
+	}
+	return h.newEndpoint(vsock.CIDHost)
+}
+
+// NewVM returns the endpoint of a new VM with a freshly allocated CID.
+func (h *Hypervisor) NewVM() *Endpoint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for {
+		cid := h.nextCID
+		h.nextCID++
+		if h.nextCID == vsock.CIDAny {
+			h.nextCID = firstCID
+		}
+		if _, ok := h.endpoints[cid]; !ok {
+			return h.newEndpoint(cid)
+		}
+	}
+}
+
+func (h *Hypervisor) newEndpoint(cid uint32) *Endpoint {
+	e := &Endpoint{h: h, cid: cid, conns: make(map[*conn]struct{})}
+	h.endpoints[cid] = e
+	return e
+}
+
+// ephemeralPort returns a port which is not in use on cid. It must be
+// called with h.mu held.
+func (h *Hypervisor) ephemeralPort(cid uint32) uint32 {
+	for {
+		port := h.nextPort
+		h.nextPort++
+		if h.nextPort == vsock.PortAny {
+			h.nextPort = firstEphemeralPort
+		}
+		if _, ok := h.listeners[vsock.Addr{CID: cid, Port: port}]; !ok {
+			return port
+		}
+	}
+}
+
+// Endpoint is a VM (or the host) attached to a Hypervisor. It
+// implements vsock.Transport and vsock.ContextDialer.
+type Endpoint struct {
+	h      *Hypervisor
+	cid    uint32
+	closed bool
+	conns  map[*conn]struct{}
+}
+
+// CID returns the context ID of the endpoint
+func (e *Endpoint) CID() uint32 {
+	return e.cid
+}
+
+// Name returns "vsocktest"
+func (e *Endpoint) Name() string {
+	return "vsocktest"
+}
+
+// Dial connects to the given port on the endpoint with the given CID.
+// vsock.CIDLocal refers to the dialling endpoint itself.
+func (e *Endpoint) Dial(cid, port uint32) (vsock.Conn, error) {
+	return e.DialContext(context.Background(), cid, port)
+}
+
+// DialContext is like Dial but fails if ctx is done before the
+// connection is established.
+func (e *Endpoint) DialContext(ctx context.Context, cid, port uint32) (vsock.Conn, error) {
+	h := e.h
+	if cid == vsock.CIDLocal {
+		cid = e.cid
+	}
+	remote := &vsock.Addr{CID: cid, Port: port}
+
+	if err := ctx.Err(); err != nil {
+		return nil, opError("dial", nil, remote, err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if e.closed {
+		return nil, opError("dial", nil, remote, syscall.ENETDOWN)
+	}
+	if _, ok := h.endpoints[cid]; !ok {
+		return nil, opError("dial", nil, remote, syscall.EHOSTUNREACH)
+	}
+	l, ok := h.listeners[*remote]
+	if !ok {
+		return nil, opError("dial", nil, remote, syscall.ECONNREFUSED)
+	}
+
+	local := &vsock.Addr{CID: e.cid, Port: h.ephemeralPort(e.cid)}
+	c, peer := newConnPair(local, remote)
+	select {
+	case l.queue <- peer:
+	default:
+		return nil, opError("dial", local, remote, syscall.ECONNREFUSED)
+	}
+	e.conns[c] = struct{}{}
+	l.e.conns[peer] = struct{}{}
+	c.e, peer.e = e, l.e
+	return c, nil
+}
+
+// Listen listens for connections on the given port. cid must be
+// vsock.CIDAny or the CID of the endpoint. Port 0 or vsock.PortAny
+// bind to a free port; use Addr() on the listener to find out which.
+//
+// The returned listener also implements vsock.Listener.
+func (e *Endpoint) Listen(cid, port uint32) (net.Listener, error) {
+	h := e.h
+	laddr := &vsock.Addr{CID: cid, Port: port}
+	if cid != vsock.CIDAny && cid != e.cid {
+		return nil, opError("listen", nil, laddr, syscall.EADDRNOTAVAIL)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if e.closed {
+		return nil, opError("listen", nil, laddr, syscall.ENETDOWN)
+	}
+	if port == 0 || port == vsock.PortAny {
+		port = h.ephemeralPort(e.cid)
+	}
+	addr := vsock.Addr{CID: e.cid, Port: port}
+	if _, ok := h.listeners[addr]; ok {
+		return nil, opError("listen", nil, laddr, syscall.EADDRINUSE)
+	}
+
+	l := &listener{
+		e:     e,
+		addr:  addr,
+		queue: make(chan *conn, backlog),
+		done:  make(chan struct{}),
+	}
+	h.listeners[addr] = l
+	return l, nil
+}
+
+// Close detaches the endpoint from the hypervisor, as if the VM was
+// destroyed. All its connections are reset, so peers see ECONNRESET,
+// and its listeners are closed. Further use of the endpoint fails with
+// ENETDOWN.
+func (e *Endpoint) Close() error {
+	h := e.h
+	h.mu.Lock()
+	if e.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	if h.endpoints[e.cid] == e {
+		delete(h.endpoints, e.cid)
+	}
+	var ls []*listener
+	for addr, l := range h.listeners {
+		if l.e == e {
+			ls = append(ls, l)
+			delete(h.listeners, addr)
+		}
+	}
+	conns := e.conns
+	e.conns = make(map[*conn]struct{})
+	h.mu.Unlock()
+
+	for _, l := range ls {
+		l.shutdown()
+	}
+	for c := range conns {
+		c.reset()
+	}
+	return nil
+}
+
+// forget removes c from the connections of its endpoint
+func (e *Endpoint) forget(c *conn) {
+	e.h.mu.Lock()
+	delete(e.conns, c)
+	e.h.mu.Unlock()
+}
+
+// opError wraps err the same way as errors from connections of the
+// vsock package.
+func opError(op string, source, addr *vsock.Addr, err error) error {
+	oerr := &net.OpError{Op: op, Net: "vsock", Err: err}
+	// Avoid storing typed nil pointers in the net.Addr interfaces
+	if source != nil {
+		oerr.Source = source
+	}
+	if addr != nil {
+		oerr.Addr = addr
+	}
+	return oerr
+}
@@ -0,0 +1,317 @@
+package vsocktest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+const testPort = 1234
+
+// connect returns both ends of a connection from the host to a new VM
+func connect(t *testing.T, h *Hypervisor) (host, guest vsock.Conn, vm *Endpoint) {
+	t.Helper()
+	vm = h.NewVM()
+	l, err := vm.Listen(vsock.CIDAny, testPort)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	host, err = h.Host().Dial(vm.CID(), testPort)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	return host, c.(vsock.Conn), vm
+}
+
+func TestAddresses(t *testing.T) {
+	h := NewHypervisor()
+	host, guest, vm := connect(t, h)
+	defer host.Close()
+	defer guest.Close()
+
+	want := &vsock.Addr{CID: vm.CID(), Port: testPort}
+	if got := host.RemoteAddr().(*vsock.Addr); *got != *want {
+		t.Errorf("host RemoteAddr: got %s, want %s", got, want)
+	}
+	if got := guest.LocalAddr().(*vsock.Addr); *got != *want {
+		t.Errorf("guest LocalAddr: got %s, want %s", got, want)
+	}
+	if got := guest.RemoteAddr().(*vsock.Addr); *got != *host.LocalAddr().(*vsock.Addr) {
+		t.Errorf("guest RemoteAddr: got %s, want %s", got, host.LocalAddr())
+	}
+	if got := guest.RemoteAddr().(*vsock.Addr); got.CID != vsock.CIDHost {
+		t.Errorf("guest RemoteAddr: got CID %d, want %d", got.CID, vsock.CIDHost)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	h := NewHypervisor()
+	host, guest, _ := connect(t, h)
+	defer host.Close()
+	defer guest.Close()
+
+	if _, err := host.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := host.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if _, err := host.Write([]byte("more")); !errors.Is(err, syscall.EPIPE) {
+		t.Errorf("Write after CloseWrite: got %v, want EPIPE", err)
+	}
+
+	got, err := io.ReadAll(guest)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("guest read %q, want %q", got, "ping")
+	}
+
+	// The other direction still works
+	if _, err := guest.Write([]byte("pong")); err != nil {
+		t.Fatalf("Write after peer's CloseWrite: %v", err)
+	}
+	if err := guest.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	got, err = io.ReadAll(host)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "pong" {
+		t.Errorf("host read %q, want %q", got, "pong")
+	}
+}
+
+func TestCloseRead(t *testing.T) {
+	h := NewHypervisor()
+	host, guest, _ := connect(t, h)
+	defer host.Close()
+	defer guest.Close()
+
+	if err := guest.CloseRead(); err != nil {
+		t.Fatalf("CloseRead: %v", err)
+	}
+	if n, err := guest.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read after CloseRead: got %d, %v, want EOF", n, err)
+	}
+	if _, err := host.Write([]byte("ping")); !errors.Is(err, syscall.EPIPE) {
+		t.Errorf("Write to peer after CloseRead: got %v, want EPIPE", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	h := NewHypervisor()
+	host, guest, _ := connect(t, h)
+	defer host.Close()
+	defer guest.Close()
+
+	if err := guest.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	_, err := guest.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read: got %v, want os.ErrDeadlineExceeded", err)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read: %v is not a timeout", err)
+	}
+
+	// Clearing the deadline makes Read block again until data arrives
+	if err := guest.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	go host.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if n, err := guest.Read(buf); n != 1 || err != nil {
+		t.Errorf("Read after clearing the deadline: got %d, %v", n, err)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	h := NewHypervisor()
+	host, guest, _ := connect(t, h)
+	defer host.Close()
+	defer guest.Close()
+
+	// Nobody reads, so the write blocks once the buffer is full
+	if err := host.SetWriteDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatalf("SetWriteDeadline: %v", err)
+	}
+	n, err := host.Write(make([]byte, 2*bufferSize))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write: got %v, want os.ErrDeadlineExceeded", err)
+	}
+	if n != bufferSize {
+		t.Errorf("Write: wrote %d bytes, want %d", n, bufferSize)
+	}
+
+	// A deadline in the past fails immediately
+	if err := host.SetDeadline(time.Unix(1, 0)); err != nil {
+		t.Fatalf("SetDeadline: %v", err)
+	}
+	if _, err := host.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read with past deadline: got %v", err)
+	}
+}
+
+func TestConnRefused(t *testing.T) {
+	h := NewHypervisor()
+	vm := h.NewVM()
+
+	_, err := h.Host().Dial(vm.CID(), testPort)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("Dial without listener: got %v, want ECONNREFUSED", err)
+	}
+
+	l, err := vm.Listen(vsock.CIDAny, testPort)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	l.Close()
+	_, err = h.Host().Dial(vm.CID(), testPort)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("Dial after closing the listener: got %v, want ECONNREFUSED", err)
+	}
+
+	_, err = h.Host().Dial(vm.CID()+1, testPort)
+	if !errors.Is(err, syscall.EHOSTUNREACH) {
+		t.Errorf("Dial to unknown CID: got %v, want EHOSTUNREACH", err)
+	}
+}
+
+func TestEndpointCloseResets(t *testing.T) {
+	h := NewHypervisor()
+	host, guest, vm := connect(t, h)
+	defer host.Close()
+
+	l, err := vm.Listen(vsock.CIDAny, testPort+1)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+
+	// A blocked Read is woken up by the reset
+	read := make(chan error, 1)
+	go func() {
+		_, err := host.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	if err := vm.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := <-read; !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("host Read: got %v, want ECONNRESET", err)
+	}
+	if _, err := host.Write([]byte("x")); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("host Write: got %v, want ECONNRESET", err)
+	}
+	if _, err := guest.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("guest Read: got %v, want ECONNRESET", err)
+	}
+	if err := <-accepted; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept: got %v, want net.ErrClosed", err)
+	}
+
+	if _, err := vm.Dial(vsock.CIDHost, testPort); !errors.Is(err, syscall.ENETDOWN) {
+		t.Errorf("Dial from closed endpoint: got %v, want ENETDOWN", err)
+	}
+	if _, err := h.Host().Dial(vm.CID(), testPort); !errors.Is(err, syscall.EHOSTUNREACH) {
+		t.Errorf("Dial to closed endpoint: got %v, want EHOSTUNREACH", err)
+	}
+}
+
+func TestListenerCloseResetsQueued(t *testing.T) {
+	h := NewHypervisor()
+	vm := h.NewVM()
+	l, err := vm.Listen(vsock.CIDAny, testPort)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	c, err := h.Host().Dial(vm.CID(), testPort)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	l.Close()
+
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Read on unaccepted connection: got %v, want ECONNRESET", err)
+	}
+}
+
+func TestAcceptContext(t *testing.T) {
+	h := NewHypervisor()
+	vm := h.NewVM()
+	l, err := vm.Listen(vsock.CIDAny, testPort)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.(vsock.Listener).AcceptContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AcceptContext: got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	h := NewHypervisor()
+	vm := h.NewVM()
+
+	l, err := vm.Listen(vm.CID(), vsock.PortAny)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	addr := l.Addr().(vsock.Addr)
+	if addr.CID != vm.CID() || addr.Port == vsock.PortAny {
+		t.Errorf("Addr: got %s", addr)
+	}
+
+	if _, err := vm.Listen(vsock.CIDAny, addr.Port); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Listen on bound port: got %v, want EADDRINUSE", err)
+	}
+	if _, err := vm.Listen(vm.CID()+1, testPort); !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		t.Errorf("Listen on other CID: got %v, want EADDRNOTAVAIL", err)
+	}
+
+	// CIDLocal connects to the endpoint itself
+	c, err := vm.Dial(vsock.CIDLocal, addr.Port)
+	if err != nil {
+		t.Fatalf("Dial CIDLocal: %v", err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer s.Close()
+	go c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(s, buf); err != nil || !bytes.Equal(buf, []byte("hello")) {
+		t.Errorf("ReadFull: got %q, %v", buf, err)
+	}
+}